@@ -0,0 +1,9 @@
+package main
+
+import (
+	"github.com/nodearmor/daemon/internal/controllersim"
+)
+
+func main() {
+	controllersim.Run()
+}
@@ -0,0 +1,63 @@
+package cmd
+
+import (
+	"bufio"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/spf13/cobra"
+)
+
+var enrollFlags struct {
+	Timeout time.Duration
+}
+
+func init() {
+	enrollCmd.Flags().DurationVar(&enrollFlags.Timeout, "timeout", 0, "Maximum time to wait for the controller, 0 uses the daemon default")
+	rootCmd.AddCommand(enrollCmd)
+}
+
+// enrollArgs : mirrors nodearmord.EnrollArgs
+type enrollArgs struct {
+	Token   string
+	Timeout time.Duration
+}
+
+var enrollCmd = &cobra.Command{
+	Use:   "enroll <token>",
+	Short: "Enroll node with a one-time token",
+	Long: `Sends a one-time enrollment token to the controller, binding this node to an organisation
+and the networks the token grants. Pass - as token to read it from standard input.`,
+	Args: cobra.ExactArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		token := args[0]
+		if token == "-" {
+			line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+			if err != nil && line == "" {
+				return fmt.Errorf("Error reading token: %s", err)
+			}
+			token = strings.TrimSpace(line)
+		}
+
+		client, err := rpcClient()
+		if err != nil {
+			return err
+		}
+
+		var organization string
+		err = client.Call("DaemonRPC.Enroll", enrollArgs{Token: token, Timeout: enrollFlags.Timeout}, &organization)
+		if err != nil {
+			return fmt.Errorf("Error enrolling node: %s", err)
+		}
+
+		if organization != "" {
+			fmt.Printf("Node enrolled in %s\n", organization)
+		} else {
+			fmt.Println("Node enrolled")
+		}
+
+		return nil
+	},
+}
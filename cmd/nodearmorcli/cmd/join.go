@@ -2,14 +2,28 @@ package cmd
 
 import (
 	"fmt"
+	"time"
 
 	"github.com/spf13/cobra"
 )
 
+var joinFlags struct {
+	Wait    bool
+	Timeout time.Duration
+}
+
 func init() {
+	joinCmd.Flags().BoolVar(&joinFlags.Wait, "wait", false, "Wait until the controller approves or rejects the request")
+	joinCmd.Flags().DurationVar(&joinFlags.Timeout, "timeout", 0, "Maximum time to wait for approval, 0 waits forever")
 	rootCmd.AddCommand(joinCmd)
 }
 
+// waitArgs : mirrors nodearmord.WaitArgs
+type waitArgs struct {
+	NetworkID string
+	Timeout   time.Duration
+}
+
 var joinCmd = &cobra.Command{
 	Use:   "join <networkId>",
 	Short: "Join a network",
@@ -21,12 +35,27 @@ var joinCmd = &cobra.Command{
 			return err
 		}
 
-		var reply bool
-		err = client.Call("nodearmord.join", args[0], &reply)
+		var state string
+		err = client.Call("NetworkRPC.Join", args[0], &state)
 		if err != nil {
 			return fmt.Errorf("Error joining network: %s", err)
 		}
 
+		if joinFlags.Wait && state == "pending" {
+			fmt.Printf("Network %s: waiting for approval\n", args[0])
+
+			err = client.Call("NetworkRPC.Wait", waitArgs{NetworkID: args[0], Timeout: joinFlags.Timeout}, &state)
+			if err != nil {
+				return fmt.Errorf("Error waiting for approval: %s", err)
+			}
+		}
+
+		fmt.Printf("Network %s: %s\n", args[0], state)
+
+		if state == "rejected" {
+			return fmt.Errorf("Join of network %s rejected by controller", args[0])
+		}
+
 		return nil
 	},
 }
@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(leaveCmd)
+}
+
+var leaveCmd = &cobra.Command{
+	Use:   "leave <networkId>",
+	Short: "Leave a network",
+	Long:  `Gives up membership of a network and removes its local configuration. While the daemon is offline the controller is told once it reconnects.`,
+	Args:  cobra.MinimumNArgs(1),
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := rpcClient()
+		if err != nil {
+			return err
+		}
+
+		var state string
+		err = client.Call("NetworkRPC.Leave", args[0], &state)
+		if err != nil {
+			return fmt.Errorf("Error leaving network: %s", err)
+		}
+
+		fmt.Printf("Network %s: %s\n", args[0], state)
+
+		return nil
+	},
+}
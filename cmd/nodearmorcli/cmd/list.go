@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(listCmd)
+}
+
+var listCmd = &cobra.Command{
+	Use:   "list",
+	Short: "List networks",
+	Long:  `Lists networks this node joined or requested to join, with their membership state.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := rpcClient()
+		if err != nil {
+			return err
+		}
+
+		var reply string
+		err = client.Call("NetworkRPC.List", true, &reply)
+		if err != nil {
+			return fmt.Errorf("Error listing networks: %s", err)
+		}
+
+		fmt.Print(reply)
+
+		return nil
+	},
+}
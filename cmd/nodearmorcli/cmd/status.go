@@ -0,0 +1,34 @@
+package cmd
+
+import (
+	"fmt"
+
+	"github.com/spf13/cobra"
+)
+
+func init() {
+	rootCmd.AddCommand(statusCmd)
+}
+
+var statusCmd = &cobra.Command{
+	Use:   "status",
+	Short: "Show daemon status",
+	Long:  `Shows daemon version, uptime, quarantine imposed by the controller, controller connection with the endpoint in use, and network memberships.`,
+	Args:  cobra.NoArgs,
+	RunE: func(cmd *cobra.Command, args []string) error {
+		client, err := rpcClient()
+		if err != nil {
+			return err
+		}
+
+		var reply string
+		err = client.Call("DaemonRPC.Status", true, &reply)
+		if err != nil {
+			return fmt.Errorf("Error getting status: %s", err)
+		}
+
+		fmt.Print(reply)
+
+		return nil
+	},
+}
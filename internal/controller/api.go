@@ -1,24 +1,357 @@
 package controller
 
+import (
+	"context"
+	"crypto/ed25519"
+	"fmt"
+	"time"
+
+	"github.com/nodearmor/daemon/pkg/vpn"
+)
+
 type Event interface {
 }
 
-type InitEvent struct {
+// RemoteError : error reply of the controller to a request
+type RemoteError struct {
+	Kind    string
+	Message string
+}
+
+func (e *RemoteError) Error() string {
+	return fmt.Sprintf("%s request failed: %s", e.Kind, e.Message)
+}
+
+// InitRequest : connection handshake, NodeID is empty for nodes without credentials.
+// Protocol version and codecs are filled in by the API
+type InitRequest struct {
+	NodeID          string   `json:"nodeId,omitempty"`
+	ProtocolVersion int      `json:"protocolVersion"`
+	DaemonVersion   string   `json:"daemonVersion"`
+	VPNBackends     []string `json:"vpnBackends"`
+	Features        []string `json:"features"`
+	Codecs          []string `json:"codecs"`
+	// EnrollmentToken : one-time token binding node to an organisation, sent only while enrolling
+	EnrollmentToken string `json:"enrollmentToken,omitempty"`
+}
+
+// InitResponse : handshake reply, credentials are only issued to nodes without them
+type InitResponse struct {
+	NodeID          string   `json:"nodeId,omitempty"`
+	NodeKey         string   `json:"nodeKey,omitempty"`
+	Codec           string   `json:"codec,omitempty"`
+	ProtocolVersion int      `json:"protocolVersion,omitempty"`
+	Features        []string `json:"features,omitempty"`
+	// Organization : organisation the enrollment token bound node to
+	Organization string `json:"organization,omitempty"`
+	// Networks : memberships granted by the enrollment token
+	Networks []NetworkMembership `json:"networks,omitempty"`
+}
+
+// AuthRequest : authentication with either the node key, a MAC over a challenge nonce or a session token.
+// Node key is only sent to controllers without FeatureChallengeAuth
+type AuthRequest struct {
+	NodeID  string `json:"nodeId"`
+	NodeKey string `json:"nodeKey,omitempty"`
+	Nonce   string `json:"nonce,omitempty"`
+	MAC     string `json:"mac,omitempty"`
+	Token   string `json:"token,omitempty"`
+}
+
+// AuthChallengeRequest : asks controller for a nonce to authenticate with
+type AuthChallengeRequest struct {
+	NodeID string `json:"nodeId"`
+}
+
+// AuthChallenge : single-use nonce the node computes its MAC over
+type AuthChallenge struct {
+	Nonce string `json:"nonce"`
+}
+
+// AuthResponse : controller answer to authentication request, with a session token if one was issued
+type AuthResponse struct {
+	Success bool   `json:"success"`
+	Token   string `json:"token,omitempty"`
+	// ExpiresIn : session token lifetime in seconds
+	ExpiresIn int64 `json:"expiresIn,omitempty"`
+}
+
+// TokenRefreshRequest : exchanges a session token that is about to expire for a new one
+type TokenRefreshRequest struct {
+	Token string `json:"token"`
+}
+
+// NetworkConfig : configuration of a network node is member of, pushed by the controller
+type NetworkConfig struct {
+	NetworkID string            `json:"networkId"`
+	Kind      string            `json:"kind"`
+	Version   uint64            `json:"version"`
+	Config    vpn.NetworkConfig `json:"config"`
+}
+
+// NetworkConfigDelta : changes turning configuration BaseVersion into Version. Nodes are matched by ID,
+// routes are replaced as a whole when Routes is set
+type NetworkConfigDelta struct {
+	NetworkID   string             `json:"networkId"`
+	BaseVersion uint64             `json:"baseVersion"`
+	Version     uint64             `json:"version"`
+	AddNodes    []vpn.NodeConfig   `json:"addNodes,omitempty"`
+	UpdateNodes []vpn.NodeConfig   `json:"updateNodes,omitempty"`
+	RemoveNodes []string           `json:"removeNodes,omitempty"`
+	Routes      *[]vpn.RouteConfig `json:"routes,omitempty"`
+}
+
+// Apply : returns configuration with delta applied on top of base
+func (d NetworkConfigDelta) Apply(base NetworkConfig) (NetworkConfig, error) {
+	if base.NetworkID != d.NetworkID {
+		return base, fmt.Errorf("delta for network %s applied to network %s", d.NetworkID, base.NetworkID)
+	}
+	if base.Version != d.BaseVersion {
+		return base, fmt.Errorf("delta based on version %d, have version %d", d.BaseVersion, base.Version)
+	}
+
+	result := base
+	result.Version = d.Version
+	result.Config.Nodes = nil
+
+	removed := make(map[string]bool)
+	for _, id := range d.RemoveNodes {
+		removed[id] = true
+	}
+
+	updated := make(map[string]vpn.NodeConfig)
+	for _, node := range d.UpdateNodes {
+		updated[node.ID] = node
+	}
+
+	for _, node := range base.Config.Nodes {
+		if removed[node.ID] {
+			delete(removed, node.ID)
+			continue
+		}
+
+		if update, ok := updated[node.ID]; ok {
+			node = update
+			delete(updated, node.ID)
+		}
+
+		result.Config.Nodes = append(result.Config.Nodes, node)
+	}
+
+	// Whatever is left was not found in base
+	for _, id := range d.RemoveNodes {
+		if removed[id] {
+			return base, fmt.Errorf("removed node %s does not exist", id)
+		}
+	}
+	for _, node := range d.UpdateNodes {
+		if _, ok := updated[node.ID]; ok {
+			return base, fmt.Errorf("updated node %s does not exist", node.ID)
+		}
+	}
+
+	for _, node := range d.AddNodes {
+		for _, existing := range result.Config.Nodes {
+			if existing.ID == node.ID {
+				return base, fmt.Errorf("added node %s already exists", node.ID)
+			}
+		}
+		result.Config.Nodes = append(result.Config.Nodes, node)
+	}
+
+	if d.Routes != nil {
+		result.Config.Routes = *d.Routes
+	}
+
+	return result, nil
+}
+
+// NetworkConfigResync : asks controller to push full configuration, Version is the one node has
+type NetworkConfigResync struct {
+	NetworkID string `json:"networkId"`
+	Version   uint64 `json:"version"`
+}
+
+// NetworkConfigResult : ack or nack of applying network configuration, reported to the controller
+type NetworkConfigResult struct {
+	NetworkID string `json:"networkId"`
+	Version   uint64 `json:"version"`
+	Success   bool   `json:"success"`
+	// ConfigHash : hash of the rendered configuration files, empty if rendering failed
+	ConfigHash string `json:"configHash,omitempty"`
+	// DurationMs : time taken to apply configuration in milliseconds
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+// Membership statuses of a node in a network as decided by the controller
+const (
+	MembershipPending  = "pending"
+	MembershipApproved = "approved"
+	MembershipRejected = "rejected"
+	MembershipRemoved  = "removed"
+)
+
+// JoinNetworkRequest : node asks to become member of network
+type JoinNetworkRequest struct {
+	NetworkID string `json:"networkId"`
+	PubKey    string `json:"pubKey,omitempty"`
+}
+
+// JoinNetworkResponse : controller verdict on join request, pending until approved or rejected
+type JoinNetworkResponse struct {
+	Status string `json:"status"`
+}
+
+// LeaveNetworkRequest : node gives up membership of network
+type LeaveNetworkRequest struct {
+	NetworkID string `json:"networkId"`
+}
+
+// NetworkMembership : controller pushed change of membership, e.g. approval of a pending join
+type NetworkMembership struct {
+	NetworkID string `json:"networkId"`
+	Status    string `json:"status"`
+}
+
+// Quarantine : controller cuts node off, every network stays stopped until a release
+type Quarantine struct {
+	// Release : lifts quarantine, node asks for configuration of its networks again
+	Release bool   `json:"release,omitempty"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// StatusReport : periodic node health report
+type StatusReport struct {
+	DaemonVersion string `json:"daemonVersion"`
+	UptimeSeconds int64  `json:"uptimeSeconds"`
+	// ControllerEndpoint : controller URL the node is connected to
+	ControllerEndpoint string `json:"controllerEndpoint"`
+	// ControllerRTTMs : round-trip time of the last successful heartbeat in milliseconds, zero if none
+	ControllerRTTMs int64 `json:"controllerRttMs,omitempty"`
+	// Quarantined, QuarantineReason : whether node is in quarantine and why
+	Quarantined      bool            `json:"quarantined,omitempty"`
+	QuarantineReason string          `json:"quarantineReason,omitempty"`
+	Networks         []NetworkStatus `json:"networks"`
+}
+
+// NetworkStatus : runtime state of a single network as seen by the node
+type NetworkStatus struct {
+	NetworkID      string   `json:"networkId"`
+	Kind           string   `json:"kind"`
+	Version        uint64   `json:"version"`
+	State          string   `json:"state"`
+	Interface      string   `json:"interface,omitempty"`
+	Addresses      []string `json:"addresses,omitempty"`
+	ReachablePeers []string `json:"reachablePeers,omitempty"`
+	RxBytes        uint64   `json:"rxBytes"`
+	TxBytes        uint64   `json:"txBytes"`
+	Error          string   `json:"error,omitempty"`
+}
+
+// Built-in diagnostic probes a node may be asked to run
+const (
+	// ProbeConfig : rendered VPN configuration of NetworkID, without private keys
+	ProbeConfig = "config"
+	// ProbeRoutes : routing tables of the node
+	ProbeRoutes = "routes"
+	// ProbePing : pings Target over the tunnel of NetworkID
+	ProbePing = "ping"
+)
+
+// DiagnosticRequest : controller asks node to run a built-in probe, node answers with a DiagnosticResult
+// carrying the same RequestID
+type DiagnosticRequest struct {
+	RequestID string `json:"requestId"`
+	Probe     string `json:"probe"`
+	NetworkID string `json:"networkId,omitempty"`
+	Target    string `json:"target,omitempty"`
+}
+
+// DiagnosticResult : output of a diagnostic probe, cut at the node output limit
+type DiagnosticResult struct {
+	RequestID string `json:"requestId"`
+	Probe     string `json:"probe"`
+	Success   bool   `json:"success"`
+	Output    string `json:"output,omitempty"`
+	// Truncated : output exceeded the limit and was cut
+	Truncated  bool   `json:"truncated,omitempty"`
+	DurationMs int64  `json:"durationMs"`
+	Error      string `json:"error,omitempty"`
+}
+
+type NetworkConfigEvent struct {
+	Event
+	NetworkConfig
+}
+
+type NetworkConfigDeltaEvent struct {
+	Event
+	NetworkConfigDelta
+}
+
+type NetworkMembershipEvent struct {
+	Event
+	NetworkMembership
+}
+
+type QuarantineEvent struct {
+	Event
+	Quarantine
+}
+
+type DiagnosticRequestEvent struct {
+	Event
+	DiagnosticRequest
+}
+
+// ConnectionStateEvent : transport connection state changed, Err holds the cause of a disconnect
+type ConnectionStateEvent struct {
+	Event
+	State ConnectionState
+	Err   error
+}
+
+// UnknownEvent : packet of a type that has no registered event, Data is encoded with Codec
+type UnknownEvent struct {
+	Event
+	Type  string
+	Codec string
+	Data  []byte
+}
+
+// SecurityEvent : message rejected because its signature is missing or invalid, or it is replayed or outdated
+type SecurityEvent struct {
 	Event
-	NodeID  string
-	NodeKey string
+	Type   string
+	Reason error
 }
 
-type AuthenticationEvent struct {
+// ErrorEvent : incoming packet that could not be decoded
+type ErrorEvent struct {
 	Event
-	Success bool
+	Err error
 }
 
 type EventChannel <-chan Event
 
 type API interface {
-	Init() error
+	Init(req InitRequest) (InitResponse, error)
 	Authenticate(nodeID string, nodeKey string) error
+	SendMessage(kind string, data interface{}) error
+	Call(ctx context.Context, kind string, req interface{}, resp interface{}) error
+	SetHeartbeatInterval(interval time.Duration)
+	SetLegacyKeyAuth(allow bool)
+	SetSigningKeys(keys []ed25519.PublicKey)
+	SetAllowUnsigned(allow bool)
+	SetReplayStore(store ReplayStore)
+	SetMaxClockSkew(skew time.Duration)
+	SetOutbox(store OutboxStore, limit int, ttl time.Duration) error
+	FlushOutbox() (sent int, expired int, err error)
+	OutboxLength() int
+	LastRTT() time.Duration
+	Codec() string
+	Capabilities() Capabilities
 	Events() EventChannel
 	Run() error
 }
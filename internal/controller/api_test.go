@@ -0,0 +1,119 @@
+package controller
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/nodearmor/daemon/pkg/vpn"
+)
+
+func TestNetworkConfigDeltaApply(t *testing.T) {
+	base := NetworkConfig{
+		NetworkID: "lab",
+		Kind:      "tinc",
+		Version:   4,
+		Config: vpn.NetworkConfig{
+			SelfID: "a",
+			Nodes: []vpn.NodeConfig{
+				{ID: "a", Name: "a"},
+				{ID: "b", Name: "b"},
+			},
+		},
+	}
+
+	routes := []vpn.RouteConfig{}
+
+	tests := []struct {
+		name  string
+		delta NetworkConfigDelta
+		// err : expected error substring, empty if delta applies
+		err   string
+		nodes []string
+	}{
+		{
+			name:  "add update remove",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, AddNodes: []vpn.NodeConfig{{ID: "c", Name: "c"}}, UpdateNodes: []vpn.NodeConfig{{ID: "a", Name: "a2"}}, RemoveNodes: []string{"b"}},
+			nodes: []string{"a2", "c"},
+		},
+		{
+			name:  "routes replaced",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, Routes: &routes},
+			nodes: []string{"a", "b"},
+		},
+		{
+			name:  "other network",
+			delta: NetworkConfigDelta{NetworkID: "other", BaseVersion: 4, Version: 5},
+			err:   "applied to network lab",
+		},
+		{
+			name:  "base version mismatch",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 3, Version: 5},
+			err:   "based on version 3, have version 4",
+		},
+		{
+			name:  "remove missing node",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, RemoveNodes: []string{"x"}},
+			err:   "removed node x does not exist",
+		},
+		{
+			name:  "update missing node",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, UpdateNodes: []vpn.NodeConfig{{ID: "x"}}},
+			err:   "updated node x does not exist",
+		},
+		{
+			name:  "update removed node",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, UpdateNodes: []vpn.NodeConfig{{ID: "b"}}, RemoveNodes: []string{"b"}},
+			err:   "updated node b does not exist",
+		},
+		{
+			name:  "add duplicate node",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, AddNodes: []vpn.NodeConfig{{ID: "b"}}},
+			err:   "added node b already exists",
+		},
+		{
+			name:  "add node twice",
+			delta: NetworkConfigDelta{NetworkID: "lab", BaseVersion: 4, Version: 5, AddNodes: []vpn.NodeConfig{{ID: "c"}, {ID: "c"}}},
+			err:   "added node c already exists",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, err := test.delta.Apply(base)
+
+			if test.err != "" {
+				if err == nil || !strings.Contains(err.Error(), test.err) {
+					t.Fatalf("expected error containing %q, got %v", test.err, err)
+				}
+				if !reflect.DeepEqual(result, base) {
+					t.Fatalf("failed delta changed configuration")
+				}
+				return
+			}
+
+			if err != nil {
+				t.Fatal(err)
+			}
+			if result.Version != test.delta.Version || result.Kind != base.Kind || result.Config.SelfID != base.Config.SelfID {
+				t.Fatalf("unexpected configuration %+v", result)
+			}
+
+			var nodes []string
+			for _, node := range result.Config.Nodes {
+				nodes = append(nodes, node.Name)
+			}
+			if !reflect.DeepEqual(nodes, test.nodes) {
+				t.Fatalf("nodes %v, expected %v", nodes, test.nodes)
+			}
+			if test.delta.Routes != nil && !reflect.DeepEqual(result.Config.Routes, routes) {
+				t.Fatalf("routes not replaced")
+			}
+		})
+	}
+
+	// Applying must not modify the node list of base
+	if base.Config.Nodes[0].Name != "a" || len(base.Config.Nodes) != 2 {
+		t.Fatalf("base configuration modified")
+	}
+}
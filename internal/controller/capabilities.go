@@ -0,0 +1,56 @@
+package controller
+
+// ProtocolVersion : controller protocol version spoken by this package
+const ProtocolVersion = 1
+
+// Optional protocol features, used only when negotiated with the controller
+const (
+	FeatureHeartbeat = "heartbeat"
+	// FeatureChallengeAuth : node proves key possession with an HMAC over a controller nonce
+	// and authenticates later connections with short-lived session tokens
+	FeatureChallengeAuth = "challengeAuth"
+)
+
+// SupportedFeatures : features this package implements itself
+var SupportedFeatures = []string{
+	FeatureHeartbeat,
+	FeatureChallengeAuth,
+}
+
+// Capabilities : protocol version and features negotiated with the controller
+type Capabilities struct {
+	ProtocolVersion int
+	Features        map[string]bool
+}
+
+// newCapabilities : builds capabilities from handshake reply, version is the lower of both sides
+func newCapabilities(version int, features []string) Capabilities {
+	if version <= 0 || version > ProtocolVersion {
+		version = ProtocolVersion
+	}
+
+	c := Capabilities{
+		ProtocolVersion: version,
+		Features:        make(map[string]bool),
+	}
+	for _, feature := range features {
+		c.Features[feature] = true
+	}
+
+	return c
+}
+
+// Has : whether feature was negotiated
+func (c Capabilities) Has(feature string) bool {
+	return c.Features[feature]
+}
+
+// List : returns negotiated features
+func (c Capabilities) List() []string {
+	var features []string
+	for feature := range c.Features {
+		features = append(features, feature)
+	}
+
+	return features
+}
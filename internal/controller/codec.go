@@ -0,0 +1,221 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+
+	"github.com/fxamacker/cbor/v2"
+	"github.com/vmihailenco/msgpack/v5"
+)
+
+// DefaultCodec : codec used until another one is negotiated
+const DefaultCodec = "json"
+
+// Codec : encodes controller messages, every codec uses the json struct tags
+type Codec interface {
+	Name() string
+	// Binary : whether encoded messages are binary rather than text
+	Binary() bool
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+	// DecodePacket : decodes envelope, leaving Data encoded
+	DecodePacket(p []byte) (RawPacket, error)
+	// Raw : wraps already encoded data so that Marshal embeds it unchanged
+	Raw(data []byte) interface{}
+}
+
+// RawPacket : packet with data left encoded until its type is known
+type RawPacket struct {
+	ID        uint64
+	Type      string
+	Data      []byte
+	Error     string
+	Seq       uint64
+	Timestamp int64
+	Signature []byte
+
+	// codec : codec Data is encoded with
+	codec Codec
+	// failure : set instead of a reply for calls that can no longer be answered
+	failure error
+}
+
+// codecRegistry : codecs by name
+var codecRegistry = map[string]Codec{}
+
+// codecPreference : codec names, most preferred first
+var codecPreference []string
+
+func init() {
+	RegisterCodec(cborCodec{})
+	RegisterCodec(msgpackCodec{})
+	RegisterCodec(jsonCodec{})
+}
+
+// RegisterCodec : makes codec available for negotiation, later registrations are less preferred
+func RegisterCodec(c Codec) {
+	if _, ok := codecRegistry[c.Name()]; !ok {
+		codecPreference = append(codecPreference, c.Name())
+	}
+	codecRegistry[c.Name()] = c
+}
+
+// GetCodec : returns codec by name, nil if not registered
+func GetCodec(name string) Codec {
+	return codecRegistry[name]
+}
+
+// SupportedCodecs : returns names of registered codecs, most preferred first
+func SupportedCodecs() []string {
+	return append([]string(nil), codecPreference...)
+}
+
+type jsonCodec struct{}
+
+func (jsonCodec) Name() string {
+	return "json"
+}
+
+func (jsonCodec) Binary() bool {
+	return false
+}
+
+func (jsonCodec) Marshal(v interface{}) ([]byte, error) {
+	return json.Marshal(v)
+}
+
+func (jsonCodec) Unmarshal(data []byte, v interface{}) error {
+	return json.Unmarshal(data, v)
+}
+
+func (c jsonCodec) DecodePacket(p []byte) (RawPacket, error) {
+	var packet struct {
+		ID    uint64          `json:"id"`
+		Type  string          `json:"type"`
+		Data  json.RawMessage `json:"data"`
+		Error string          `json:"error"`
+		Seq   uint64          `json:"seq"`
+		Ts    int64           `json:"ts"`
+		Sig   []byte          `json:"sig"`
+	}
+
+	err := json.Unmarshal(p, &packet)
+
+	return RawPacket{
+		ID:        packet.ID,
+		Type:      packet.Type,
+		Data:      packet.Data,
+		Error:     packet.Error,
+		Seq:       packet.Seq,
+		Timestamp: packet.Ts,
+		Signature: packet.Sig,
+		codec:     c,
+	}, err
+}
+
+func (jsonCodec) Raw(data []byte) interface{} {
+	return json.RawMessage(data)
+}
+
+type cborCodec struct{}
+
+func (cborCodec) Name() string {
+	return "cbor"
+}
+
+func (cborCodec) Binary() bool {
+	return true
+}
+
+func (cborCodec) Marshal(v interface{}) ([]byte, error) {
+	return cbor.Marshal(v)
+}
+
+func (cborCodec) Unmarshal(data []byte, v interface{}) error {
+	return cbor.Unmarshal(data, v)
+}
+
+func (c cborCodec) DecodePacket(p []byte) (RawPacket, error) {
+	var packet struct {
+		ID    uint64          `json:"id"`
+		Type  string          `json:"type"`
+		Data  cbor.RawMessage `json:"data"`
+		Error string          `json:"error"`
+		Seq   uint64          `json:"seq"`
+		Ts    int64           `json:"ts"`
+		Sig   []byte          `json:"sig"`
+	}
+
+	err := cbor.Unmarshal(p, &packet)
+
+	return RawPacket{
+		ID:        packet.ID,
+		Type:      packet.Type,
+		Data:      packet.Data,
+		Error:     packet.Error,
+		Seq:       packet.Seq,
+		Timestamp: packet.Ts,
+		Signature: packet.Sig,
+		codec:     c,
+	}, err
+}
+
+func (cborCodec) Raw(data []byte) interface{} {
+	return cbor.RawMessage(data)
+}
+
+type msgpackCodec struct{}
+
+func (msgpackCodec) Name() string {
+	return "msgpack"
+}
+
+func (msgpackCodec) Binary() bool {
+	return true
+}
+
+func (msgpackCodec) Marshal(v interface{}) ([]byte, error) {
+	var buf bytes.Buffer
+
+	enc := msgpack.NewEncoder(&buf)
+	enc.SetCustomStructTag("json")
+	err := enc.Encode(v)
+
+	return buf.Bytes(), err
+}
+
+func (msgpackCodec) Unmarshal(data []byte, v interface{}) error {
+	dec := msgpack.NewDecoder(bytes.NewReader(data))
+	dec.SetCustomStructTag("json")
+
+	return dec.Decode(v)
+}
+
+func (c msgpackCodec) DecodePacket(p []byte) (RawPacket, error) {
+	var packet struct {
+		ID    uint64             `json:"id"`
+		Type  string             `json:"type"`
+		Data  msgpack.RawMessage `json:"data"`
+		Error string             `json:"error"`
+		Seq   uint64             `json:"seq"`
+		Ts    int64              `json:"ts"`
+		Sig   []byte             `json:"sig"`
+	}
+
+	err := c.Unmarshal(p, &packet)
+
+	return RawPacket{
+		ID:        packet.ID,
+		Type:      packet.Type,
+		Data:      packet.Data,
+		Error:     packet.Error,
+		Seq:       packet.Seq,
+		Timestamp: packet.Ts,
+		Signature: packet.Sig,
+		codec:     c,
+	}, err
+}
+
+func (msgpackCodec) Raw(data []byte) interface{} {
+	return msgpack.RawMessage(data)
+}
@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// SRVService, SRVProto : SRV record queried for controllers, _nodearmor._tcp.<domain>
+	SRVService = "nodearmor"
+	SRVProto   = "tcp"
+	// WellKnownPath : path of the controller document served by the domain
+	WellKnownPath = "/.well-known/nodearmor"
+
+	discoveryTimeout = 10 * time.Second
+	maxWellKnownSize = 64 * 1024
+)
+
+// WellKnownDocument : controller list served at WellKnownPath
+type WellKnownDocument struct {
+	Controllers []string `json:"controllers"`
+}
+
+// Discovery : finds controller URLs of a domain, first from DNS SRV records then from the well-known document
+type Discovery struct {
+	// Domain : domain whose controllers are discovered
+	Domain string
+	// Resolver : used for SRV lookups, nil for system resolver
+	Resolver *net.Resolver
+	// Client : used to fetch the well-known document, nil for http.DefaultClient
+	Client *http.Client
+}
+
+// NewResolver : returns resolver querying DNS server at address host:port, empty address for system resolver
+func NewResolver(address string) *net.Resolver {
+	if address == "" {
+		return net.DefaultResolver
+	}
+
+	return &net.Resolver{
+		PreferGo: true,
+		Dial: func(ctx context.Context, network string, _ string) (net.Conn, error) {
+			var dialer net.Dialer
+			return dialer.DialContext(ctx, network, address)
+		},
+	}
+}
+
+// Discover : returns controller URLs in order of preference
+func (d *Discovery) Discover(ctx context.Context) ([]string, error) {
+	if d.Domain == "" {
+		return nil, fmt.Errorf("no discovery domain")
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, discoveryTimeout)
+	defer cancel()
+
+	urls, srvErr := d.LookupSRV(ctx)
+	if srvErr == nil {
+		return urls, nil
+	}
+
+	urls, err := d.FetchWellKnown(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("controller discovery for %s failed: %s; %s", d.Domain, srvErr, err)
+	}
+
+	return urls, nil
+}
+
+// LookupSRV : returns wss URLs of SRV targets ordered by priority and weight
+func (d *Discovery) LookupSRV(ctx context.Context) ([]string, error) {
+	resolver := d.Resolver
+	if resolver == nil {
+		resolver = net.DefaultResolver
+	}
+
+	_, records, err := resolver.LookupSRV(ctx, SRVService, SRVProto, d.Domain)
+	if err != nil {
+		return nil, fmt.Errorf("SRV lookup failed: %s", err)
+	}
+
+	var urls []string
+	for _, record := range records {
+		target := strings.TrimSuffix(record.Target, ".")
+
+		// Single "." target means service is explicitly unavailable
+		if target == "" {
+			continue
+		}
+
+		urls = append(urls, fmt.Sprintf("wss://%s/", net.JoinHostPort(target, fmt.Sprint(record.Port))))
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("no SRV targets for %s", d.Domain)
+	}
+
+	return urls, nil
+}
+
+// FetchWellKnown : returns controller URLs listed by https://<domain>/.well-known/nodearmor
+func (d *Discovery) FetchWellKnown(ctx context.Context) ([]string, error) {
+	client := d.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+
+	documentURL := fmt.Sprintf("https://%s%s", d.Domain, WellKnownPath)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, documentURL, nil)
+	if err != nil {
+		return nil, fmt.Errorf("well-known request failed: %s", err)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("well-known request failed: %s", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("well-known request to %s failed: %s", documentURL, resp.Status)
+	}
+
+	buf, err := ioutil.ReadAll(http.MaxBytesReader(nil, resp.Body, maxWellKnownSize))
+	if err != nil {
+		return nil, fmt.Errorf("error reading well-known document: %s", err)
+	}
+
+	var doc WellKnownDocument
+	err = json.Unmarshal(buf, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing well-known document: %s", err)
+	}
+
+	var urls []string
+	for _, controller := range doc.Controllers {
+		u, err := url.Parse(controller)
+		if err != nil || (u.Scheme != "ws" && u.Scheme != "wss") || u.Host == "" {
+			return nil, fmt.Errorf("invalid controller URL %q in well-known document", controller)
+		}
+		urls = append(urls, u.String())
+	}
+
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("well-known document lists no controllers")
+	}
+
+	return urls, nil
+}
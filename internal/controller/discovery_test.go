@@ -0,0 +1,170 @@
+package controller
+
+import (
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// srvRecord : answer served by the test DNS server
+type srvRecord struct {
+	priority uint16
+	weight   uint16
+	port     uint16
+	target   string
+}
+
+// serveDNS : answers SRV queries for name with records, everything else with NXDOMAIN. Returns server address
+func serveDNS(t *testing.T, name string, records []srvRecord) string {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+
+			reply := dnsReply(buf[:n], name, records)
+			if reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}
+	}()
+
+	return conn.LocalAddr().String()
+}
+
+// dnsReply : builds response to query, nil if query is malformed
+func dnsReply(query []byte, name string, records []srvRecord) []byte {
+	if len(query) < 12 {
+		return nil
+	}
+
+	// Question section ends after the name labels, type and class
+	end := 12
+	var labels []string
+	for end < len(query) && query[end] != 0 {
+		size := int(query[end])
+		if end+1+size > len(query) {
+			return nil
+		}
+		labels = append(labels, string(query[end+1:end+1+size]))
+		end += 1 + size
+	}
+	end += 5
+	if end > len(query) {
+		return nil
+	}
+	qtype := binary.BigEndian.Uint16(query[end-4:])
+
+	reply := append([]byte(nil), query[:2]...)
+	found := strings.EqualFold(strings.Join(labels, "."), name) && qtype == 33
+	if found {
+		reply = append(reply, 0x84, 0x00)
+	} else {
+		// NXDOMAIN
+		reply = append(reply, 0x84, 0x03)
+		records = nil
+	}
+	reply = appendUint16(reply, 1)
+	reply = appendUint16(reply, uint16(len(records)))
+	reply = append(reply, 0, 0, 0, 0)
+	reply = append(reply, query[12:end]...)
+
+	for _, record := range records {
+		var target []byte
+		for _, label := range strings.Split(strings.TrimSuffix(record.target, "."), ".") {
+			if label != "" {
+				target = append(target, byte(len(label)))
+				target = append(target, label...)
+			}
+		}
+		target = append(target, 0)
+
+		// Name points back to the question
+		reply = append(reply, 0xc0, 12)
+		reply = appendUint16(reply, 33)
+		reply = appendUint16(reply, 1)
+		// TTL of 60 seconds
+		reply = appendUint16(reply, 0)
+		reply = appendUint16(reply, 60)
+		reply = appendUint16(reply, uint16(6+len(target)))
+		reply = appendUint16(reply, record.priority)
+		reply = appendUint16(reply, record.weight)
+		reply = appendUint16(reply, record.port)
+		reply = append(reply, target...)
+	}
+
+	return reply
+}
+
+func appendUint16(buf []byte, v uint16) []byte {
+	var b [2]byte
+	binary.BigEndian.PutUint16(b[:], v)
+	return append(buf, b[:]...)
+}
+
+func TestLookupSRV(t *testing.T) {
+	addr := serveDNS(t, "_nodearmor._tcp.example.test", []srvRecord{
+		{priority: 20, weight: 1, port: 8443, target: "backup.example.test."},
+		{priority: 10, weight: 1, port: 443, target: "primary.example.test."},
+		{priority: 30, weight: 1, port: 0, target: "."},
+	})
+
+	discovery := Discovery{
+		Domain:   "example.test",
+		Resolver: NewResolver(addr),
+	}
+
+	urls, err := discovery.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"wss://primary.example.test:443/", "wss://backup.example.test:8443/"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("discovered %v, expected %v", urls, expected)
+	}
+}
+
+func TestDiscoverFallsBackToWellKnown(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != WellKnownPath {
+			http.NotFound(w, r)
+			return
+		}
+		json.NewEncoder(w).Encode(WellKnownDocument{Controllers: []string{"wss://controller.example.test/"}})
+	}))
+	defer server.Close()
+
+	// No SRV records for the domain
+	addr := serveDNS(t, "_nodearmor._tcp.other.test", nil)
+
+	discovery := Discovery{
+		Domain:   server.Listener.Addr().String(),
+		Resolver: NewResolver(addr),
+		Client:   server.Client(),
+	}
+
+	urls, err := discovery.Discover(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"wss://controller.example.test/"}
+	if !reflect.DeepEqual(urls, expected) {
+		t.Fatalf("discovered %v, expected %v", urls, expected)
+	}
+}
@@ -0,0 +1,182 @@
+package fakecontroller
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+)
+
+// DefaultTokenLifetime : lifetime of session tokens unless Controller.TokenLifetime is set
+const DefaultTokenLifetime = time.Hour
+
+// TokenStore : session tokens by token value
+type TokenStore struct {
+	lock   sync.Mutex
+	tokens map[string]sessionToken
+}
+
+type sessionToken struct {
+	nodeID  string
+	expires time.Time
+}
+
+// NewTokenStore : returns empty token store
+func NewTokenStore() *TokenStore {
+	return &TokenStore{
+		tokens: make(map[string]sessionToken),
+	}
+}
+
+// Issue : returns new token of node valid for lifetime
+func (s *TokenStore) Issue(nodeID string, lifetime time.Duration) string {
+	token := randomHex(32)
+
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.tokens[token] = sessionToken{
+		nodeID:  nodeID,
+		expires: time.Now().Add(lifetime),
+	}
+
+	return token
+}
+
+// Validate : returns node token was issued to, false if unknown or expired
+func (s *TokenStore) Validate(token string) (string, bool) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	t, ok := s.tokens[token]
+	if !ok {
+		return "", false
+	}
+	if time.Now().After(t.expires) {
+		delete(s.tokens, token)
+		return "", false
+	}
+
+	return t.nodeID, true
+}
+
+// Revoke : invalidates token
+func (s *TokenStore) Revoke(token string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	delete(s.tokens, token)
+}
+
+func (c *Controller) nodeKey(nodeID string) (string, bool) {
+	if c.Keys != nil {
+		return c.Keys(nodeID)
+	}
+
+	return c.NodeKey, nodeID == c.NodeID
+}
+
+// issueToken : returns successful auth response carrying a new session token
+func (c *Controller) issueToken(nodeID string) controller.AuthResponse {
+	lifetime := c.TokenLifetime
+	if lifetime <= 0 {
+		lifetime = DefaultTokenLifetime
+	}
+
+	return controller.AuthResponse{
+		Success:   true,
+		Token:     c.Tokens.Issue(nodeID, lifetime),
+		ExpiresIn: int64(lifetime / time.Second),
+	}
+}
+
+func (c *Controller) handleAuthChallenge(req Request) (interface{}, error) {
+	nonce := randomHex(32)
+
+	c.lock.Lock()
+	c.nonce = nonce
+	c.lock.Unlock()
+
+	return controller.AuthChallenge{Nonce: nonce}, nil
+}
+
+func (c *Controller) handleAuth(req Request) (interface{}, error) {
+	var auth controller.AuthRequest
+
+	err := req.Decode(&auth)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := c.verifyAuth(auth)
+	if resp.Success {
+		c.lock.Lock()
+		c.node = auth.NodeID
+		c.lock.Unlock()
+	}
+
+	return resp, nil
+}
+
+// verifyAuth : checks token, challenge MAC or node key of auth request
+func (c *Controller) verifyAuth(auth controller.AuthRequest) controller.AuthResponse {
+	switch {
+	case auth.Token != "":
+		nodeID, ok := c.Tokens.Validate(auth.Token)
+		if !ok || nodeID != auth.NodeID {
+			return controller.AuthResponse{}
+		}
+		c.Tokens.Revoke(auth.Token)
+
+		return c.issueToken(nodeID)
+	case auth.MAC != "":
+		// Nonce is single use
+		c.lock.Lock()
+		nonce := c.nonce
+		c.nonce = ""
+		c.lock.Unlock()
+
+		key, ok := c.nodeKey(auth.NodeID)
+		if !ok || nonce == "" || auth.Nonce != nonce || !controller.VerifyChallengeMAC(key, auth.NodeID, nonce, auth.MAC) {
+			return controller.AuthResponse{}
+		}
+
+		return c.issueToken(auth.NodeID)
+	default:
+		key, ok := c.nodeKey(auth.NodeID)
+
+		return controller.AuthResponse{
+			Success: ok && auth.NodeKey != "" && key == auth.NodeKey,
+		}
+	}
+}
+
+func (c *Controller) handleAuthRefresh(req Request) (interface{}, error) {
+	var refresh controller.TokenRefreshRequest
+
+	err := req.Decode(&refresh)
+	if err != nil {
+		return nil, err
+	}
+
+	nodeID, ok := c.Tokens.Validate(refresh.Token)
+	if !ok {
+		return nil, fmt.Errorf("invalid session token")
+	}
+	c.Tokens.Revoke(refresh.Token)
+
+	return c.issueToken(nodeID), nil
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(buf)
+}
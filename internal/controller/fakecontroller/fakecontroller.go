@@ -0,0 +1,329 @@
+// Package fakecontroller : scriptable controller speaking the controller protocol over any transport,
+// for exercising the controller API and daemon without a live controller
+package fakecontroller
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+)
+
+const receivedQueueSize = 256
+
+// HandlerFunc : answers request, returned error is sent back as the reply error
+type HandlerFunc func(req Request) (interface{}, error)
+
+// Request : message received from the node
+type Request struct {
+	ID   uint64
+	Type string
+	Data []byte
+
+	codec controller.Codec
+}
+
+// Decode : decodes request data into v
+func (r Request) Decode(v interface{}) error {
+	return r.codec.Unmarshal(r.Data, v)
+}
+
+// Controller : fake controller, answers init, auth and heartbeat unless handlers are replaced
+type Controller struct {
+	// NodeID, NodeKey : credentials issued on init and accepted on auth
+	NodeID  string
+	NodeKey string
+	// Codec : codec selected on init if the node offers it, empty keeps default
+	Codec string
+	// Features : features accepted on init if the node requests them
+	Features []string
+	// Keys : looks up node key on auth, nil accepts only NodeID and NodeKey
+	Keys func(nodeID string) (string, bool)
+	// Tokens : session tokens issued on auth, share between controllers to accept tokens across connections
+	Tokens *TokenStore
+	// TokenLifetime : lifetime of issued session tokens
+	TokenLifetime time.Duration
+	// SigningKey : signs pushed messages whose type requires a signature, nil sends them unsigned
+	SigningKey ed25519.PrivateKey
+
+	transport controller.Transport
+
+	lock  sync.Mutex
+	nonce string
+	// node : id of the node authenticated on this connection, signed pushes are addressed to it
+	node     string
+	codec    controller.Codec
+	handlers map[string]HandlerFunc
+	received chan Request
+}
+
+// New : returns fake controller talking over t, Run has to be called to process messages
+func New(t controller.Transport) *Controller {
+	c := &Controller{
+		NodeID:        "node",
+		NodeKey:       "key",
+		Features:      controller.SupportedFeatures,
+		Tokens:        NewTokenStore(),
+		TokenLifetime: DefaultTokenLifetime,
+
+		transport: t,
+		codec:     controller.GetCodec(controller.DefaultCodec),
+		handlers:  make(map[string]HandlerFunc),
+		received:  make(chan Request, receivedQueueSize),
+	}
+
+	c.Handle("init", c.handleInit)
+	c.Handle("auth", c.handleAuth)
+	c.Handle("authChallenge", c.handleAuthChallenge)
+	c.Handle("authRefresh", c.handleAuthRefresh)
+	c.Handle("heartbeat", func(req Request) (interface{}, error) {
+		return struct{}{}, nil
+	})
+
+	return c
+}
+
+// Handle : sets handler for message type, nil handler makes requests of that type fail
+func (c *Controller) Handle(kind string, handler HandlerFunc) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if handler == nil {
+		delete(c.handlers, kind)
+		return
+	}
+	c.handlers[kind] = handler
+}
+
+// Handler : returns handler of message type, for wrapping default handlers
+func (c *Controller) Handler(kind string) HandlerFunc {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.handlers[kind]
+}
+
+// Push : sends unsolicited message to the node
+func (c *Controller) Push(kind string, data interface{}) error {
+	if !controller.RequiresSignature(kind) {
+		return c.send(controller.Packet{
+			Type: kind,
+			Data: data,
+		})
+	}
+
+	seq := NextSequence()
+	timestamp := time.Now().UnixNano() / int64(time.Millisecond)
+
+	if c.SigningKey == nil {
+		return c.send(controller.Packet{
+			Type:      kind,
+			Data:      data,
+			Seq:       seq,
+			Timestamp: timestamp,
+		})
+	}
+
+	c.lock.Lock()
+	codec, node := c.codec, c.node
+	c.lock.Unlock()
+
+	// Signature covers data exactly as encoded on the wire
+	buf, err := codec.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %s", codec.Name(), err)
+	}
+
+	return c.sendWith(codec, controller.Packet{
+		Type:      kind,
+		Data:      codec.Raw(buf),
+		Seq:       seq,
+		Timestamp: timestamp,
+		Signature: controller.SignPacket(c.SigningKey, node, kind, seq, timestamp, buf),
+	})
+}
+
+// lastSequence : sequence number of the last message pushed by any fake controller of the process
+var lastSequence uint64
+
+// NextSequence : returns sequence number for a pushed message. Sequences start from the current time
+// so that they keep increasing across restarts, as nodes persist the last one they accepted
+func NextSequence() uint64 {
+	for {
+		last := atomic.LoadUint64(&lastSequence)
+
+		next := uint64(time.Now().UnixNano())
+		if next <= last {
+			next = last + 1
+		}
+
+		if atomic.CompareAndSwapUint64(&lastSequence, last, next) {
+			return next
+		}
+	}
+}
+
+// Expect : waits for next message from the node and checks its type
+func (c *Controller) Expect(kind string, timeout time.Duration) (Request, error) {
+	select {
+	case req := <-c.received:
+		if req.Type != kind {
+			return req, fmt.Errorf("expected %s message, received %s", kind, req.Type)
+		}
+		return req, nil
+	case <-time.After(timeout):
+		return Request{}, fmt.Errorf("no %s message received within %s", kind, timeout)
+	}
+}
+
+// Run : processes messages until transport fails
+func (c *Controller) Run() error {
+	for {
+		p, err := c.transport.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		c.lock.Lock()
+		codec := c.codec
+		c.lock.Unlock()
+
+		packet, err := codec.DecodePacket(p)
+		if err != nil {
+			return fmt.Errorf("failed to unmarshal %s packet: %s", codec.Name(), err)
+		}
+
+		req := Request{
+			ID:    packet.ID,
+			Type:  packet.Type,
+			Data:  packet.Data,
+			codec: codec,
+		}
+
+		// Keep processing even if nobody checks received messages
+		select {
+		case c.received <- req:
+		default:
+		}
+
+		err = c.handle(req)
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (c *Controller) handle(req Request) error {
+	c.lock.Lock()
+	handler, ok := c.handlers[req.Type]
+	c.lock.Unlock()
+
+	var data interface{}
+	var handlerErr error
+	if ok {
+		data, handlerErr = handler(req)
+	} else {
+		handlerErr = fmt.Errorf("unsupported message type %s", req.Type)
+	}
+
+	// Messages without ID expect no reply
+	if req.ID == 0 {
+		return nil
+	}
+
+	reply := controller.Packet{
+		ID:   req.ID,
+		Type: req.Type,
+		Data: data,
+	}
+	if handlerErr != nil {
+		reply.Error = handlerErr.Error()
+	}
+
+	err := c.send(reply)
+	if err != nil {
+		return err
+	}
+
+	// Node switches codec once it has read the init reply, so does the controller after sending it
+	if resp, ok := data.(controller.InitResponse); ok && resp.Codec != "" {
+		c.setCodec(resp.Codec)
+	}
+
+	return nil
+}
+
+func (c *Controller) send(msg controller.Packet) error {
+	c.lock.Lock()
+	codec := c.codec
+	c.lock.Unlock()
+
+	return c.sendWith(codec, msg)
+}
+
+func (c *Controller) sendWith(codec controller.Codec, msg controller.Packet) error {
+	buf, err := codec.Marshal(msg)
+	if err != nil {
+		return fmt.Errorf("failed to marshal %s: %s", codec.Name(), err)
+	}
+
+	return c.transport.WriteMessage(buf)
+}
+
+func (c *Controller) setCodec(name string) {
+	codec := controller.GetCodec(name)
+	if codec == nil {
+		return
+	}
+
+	c.lock.Lock()
+	c.codec = codec
+	c.lock.Unlock()
+
+	if setter, ok := c.transport.(controller.BinarySetter); ok {
+		setter.SetBinary(codec.Binary())
+	}
+}
+
+func (c *Controller) handleInit(req Request) (interface{}, error) {
+	var init controller.InitRequest
+
+	err := req.Decode(&init)
+	if err != nil {
+		return nil, err
+	}
+
+	resp := controller.InitResponse{
+		ProtocolVersion: controller.ProtocolVersion,
+		Features:        intersect(c.Features, init.Features),
+	}
+
+	if init.NodeID == "" {
+		resp.NodeID = c.NodeID
+		resp.NodeKey = c.NodeKey
+	}
+
+	if len(intersect([]string{c.Codec}, init.Codecs)) > 0 {
+		resp.Codec = c.Codec
+	}
+
+	return resp, nil
+}
+
+// intersect : returns items of a that are also in b
+func intersect(a []string, b []string) []string {
+	var items []string
+	for _, x := range a {
+		for _, y := range b {
+			if x == y {
+				items = append(items, x)
+				break
+			}
+		}
+	}
+
+	return items
+}
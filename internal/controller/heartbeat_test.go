@@ -0,0 +1,59 @@
+package controller_test
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/internal/controller/fakecontroller"
+)
+
+func TestHeartbeatRTT(t *testing.T) {
+	node, remote := controller.NewLoopbackPair()
+	defer node.Close()
+
+	fake := fakecontroller.New(remote)
+	go fake.Run()
+
+	api := controller.NewJsonAPI(node).(*controller.JsonAPI)
+	go api.Run()
+
+	// Error reply shows controller is alive but has no meaningful round-trip time
+	fake.Handle("heartbeat", func(req fakecontroller.Request) (interface{}, error) {
+		return nil, fmt.Errorf("busy")
+	})
+	err := api.Heartbeat(time.Second)
+	if err != nil {
+		t.Fatalf("answered heartbeat failed: %s", err)
+	}
+	if api.LastRTT() != 0 {
+		t.Fatalf("round-trip time recorded from error reply")
+	}
+
+	fake.Handle("heartbeat", func(req fakecontroller.Request) (interface{}, error) {
+		time.Sleep(10 * time.Millisecond)
+		return struct{}{}, nil
+	})
+	err = api.Heartbeat(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if api.LastRTT() < 10*time.Millisecond {
+		t.Fatalf("round-trip time %s not recorded", api.LastRTT())
+	}
+
+	// Unanswered heartbeat is an error and keeps the last round-trip time
+	last := api.LastRTT()
+	fake.Handle("heartbeat", func(req fakecontroller.Request) (interface{}, error) {
+		time.Sleep(200 * time.Millisecond)
+		return struct{}{}, nil
+	})
+	err = api.Heartbeat(50 * time.Millisecond)
+	if err == nil {
+		t.Fatalf("unanswered heartbeat succeeded")
+	}
+	if api.LastRTT() != last {
+		t.Fatalf("round-trip time changed by unanswered heartbeat")
+	}
+}
@@ -1,154 +1,554 @@
 package controller
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"errors"
 	"fmt"
+	"sync"
+	"time"
 )
 
 const (
-	MaxPacketSize = 512
+	DefaultCallTimeout       = 10 * time.Second
+	DefaultHeartbeatInterval = 30 * time.Second
+	eventQueueSize           = 16
 )
 
+// ErrConnectionLost : call failed because the connection dropped before its reply arrived
+var ErrConnectionLost = errors.New("connection lost")
+
 func NewJsonAPI(t Transport) API {
-	return &JsonAPI{
-		transport: t,
+	a := &JsonAPI{
+		transport:         t,
+		eventChan:         make(chan Event, eventQueueSize),
+		pending:           make(map[uint64]pendingCall),
+		codec:             GetCodec(DefaultCodec),
+		capabilities:      newCapabilities(0, nil),
+		heartbeatInterval: DefaultHeartbeatInterval,
+		replayStore:       NewMemoryReplayStore(),
+		maxSkew:           DefaultMaxClockSkew,
+		outbox: outbox{
+			limit: DefaultOutboxLimit,
+			ttl:   DefaultOutboxTTL,
+		},
+		connected: true,
+	}
+
+	if notifier, ok := t.(StateNotifier); ok {
+		a.connected = false
+		notifier.SetStateHandler(a.onStateChange)
 	}
+
+	return a
 }
 
+// Packet : message envelope, ID is set on requests and echoed on their replies
 type Packet struct {
-	Type string      `json:"type"`
-	Data interface{} `json:"data"`
+	ID    uint64      `json:"id,omitempty"`
+	Type  string      `json:"type"`
+	Data  interface{} `json:"data"`
+	Error string      `json:"error,omitempty"`
+	// Seq, Timestamp : controller sequence number and unix time in milliseconds, covered by Signature
+	Seq       uint64 `json:"seq,omitempty"`
+	Timestamp int64  `json:"ts,omitempty"`
+	// Signature : controller Ed25519 signature, see SignPacket
+	Signature []byte `json:"sig,omitempty"`
+}
+
+// pendingCall : call waiting for its reply
+type pendingCall struct {
+	reply chan RawPacket
+	// onReply : runs on the reading goroutine before any later packet is decoded
+	onReply func(packet RawPacket)
 }
 
+// JsonAPI : controller API speaking JSON until init negotiates another codec
 type JsonAPI struct {
 	transport Transport
 	eventChan chan Event
+
+	writeLock sync.Mutex
+
+	pendingLock sync.Mutex
+	pending     map[uint64]pendingCall
+	lastID      uint64
+
+	stateLock         sync.Mutex
+	connected         bool
+	codec             Codec
+	capabilities      Capabilities
+	heartbeatInterval time.Duration
+	lastRTT           time.Duration
+
+	sessionLock sync.Mutex
+	session     session
+	// legacyKeyAuth : allows sending node key itself to controllers without FeatureChallengeAuth
+	legacyKeyAuth bool
+
+	signingLock   sync.Mutex
+	signingKeys   []ed25519.PublicKey
+	allowUnsigned bool
+	// recipient : id of the authenticated node, signed packets have to be addressed to it
+	recipient   string
+	replayStore ReplayStore
+	maxSkew     time.Duration
+
+	outboxLock sync.Mutex
+	outbox     outbox
 }
 
-func (a *JsonAPI) SendMessage(kind string, data interface{}) error {
-	msg := Packet{
-		Type: kind,
-		Data: data,
+func (a *JsonAPI) currentCodec() Codec {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	return a.codec
+}
+
+// setCodec : switches codec of both directions, unknown names are ignored
+func (a *JsonAPI) setCodec(name string) {
+	codec := GetCodec(name)
+	if codec == nil {
+		return
+	}
+
+	a.stateLock.Lock()
+	a.codec = codec
+	a.stateLock.Unlock()
+
+	if setter, ok := a.transport.(BinarySetter); ok {
+		setter.SetBinary(codec.Binary())
 	}
+}
+
+// Codec : returns name of codec currently in use
+func (a *JsonAPI) Codec() string {
+	return a.currentCodec().Name()
+}
+
+// Capabilities : returns capabilities negotiated on current connection
+func (a *JsonAPI) Capabilities() Capabilities {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	return a.capabilities
+}
+
+func (a *JsonAPI) setCapabilities(c Capabilities) {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	a.capabilities = c
+}
+
+func (a *JsonAPI) send(msg Packet) error {
+	a.writeLock.Lock()
+	defer a.writeLock.Unlock()
 
-	buf, err := json.Marshal(msg)
+	codec := a.currentCodec()
+
+	buf, err := codec.Marshal(msg)
 	if err != nil {
-		return fmt.Errorf("failed to marshal json: %s", err)
+		return fmt.Errorf("failed to marshal %s: %s", codec.Name(), err)
 	}
 
-	n, err := a.transport.Write(buf)
+	err = a.transport.WriteMessage(buf)
 	if err != nil {
 		return fmt.Errorf("transport write failed: %s", err)
 	}
-	if n != len(buf) {
-		return fmt.Errorf("transport writen %d out of %d bytes (%s)", n, len(buf), err)
-	}
 
 	return nil
 }
 
-func (a *JsonAPI) Init() error {
-	return a.SendMessage("init", struct{}{})
+// SendMessage : sends message without waiting for a reply. Types queued while offline wait in the outbox
+// until it is flushed instead of failing
+func (a *JsonAPI) SendMessage(kind string, data interface{}) error {
+	if QueuedWhileOffline(kind) {
+		return a.sendQueued(kind, data)
+	}
+
+	return a.send(Packet{
+		Type: kind,
+		Data: data,
+	})
+}
+
+// Call : sends request and waits for the correlated reply, decoding it into resp
+func (a *JsonAPI) Call(ctx context.Context, kind string, req interface{}, resp interface{}) error {
+	return a.call(ctx, kind, req, resp, nil)
 }
 
-func (a *JsonAPI) Authenticate(nodeID string, nodeKey string) error {
-	var AuthRequest struct {
-		NodeID  string `json:"nodeId"`
-		NodeKey string `json:"nodeKey"`
+func (a *JsonAPI) call(ctx context.Context, kind string, req interface{}, resp interface{}, onReply func(RawPacket)) error {
+	id, replyChan := a.addPending(onReply)
+	defer a.removePending(id)
+
+	err := a.send(Packet{
+		ID:   id,
+		Type: kind,
+		Data: req,
+	})
+	if err != nil {
+		return err
 	}
 
-	AuthRequest.NodeID = nodeID
-	AuthRequest.NodeKey = nodeKey
+	select {
+	case reply := <-replyChan:
+		if reply.failure != nil {
+			return reply.failure
+		}
+		if reply.Error != "" {
+			return &RemoteError{Kind: kind, Message: reply.Error}
+		}
 
-	return a.SendMessage("auth", AuthRequest)
+		if resp != nil && len(reply.Data) > 0 {
+			err = reply.codec.Unmarshal(reply.Data, resp)
+			if err != nil {
+				return fmt.Errorf("failed to unmarshal %s reply: %s", kind, err)
+			}
+		}
+
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("%s request failed: %s", kind, ctx.Err())
+	}
 }
 
-func (a *JsonAPI) ParseMessage(p []byte) {
+func (a *JsonAPI) addPending(onReply func(RawPacket)) (uint64, chan RawPacket) {
+	a.pendingLock.Lock()
+	defer a.pendingLock.Unlock()
+
+	a.lastID++
+	replyChan := make(chan RawPacket, 1)
+	a.pending[a.lastID] = pendingCall{
+		reply:   replyChan,
+		onReply: onReply,
+	}
 
+	return a.lastID, replyChan
 }
 
-func (a *JsonAPI) Events() EventChannel {
-	return a.eventChan
+func (a *JsonAPI) removePending(id uint64) {
+	a.pendingLock.Lock()
+	defer a.pendingLock.Unlock()
+
+	delete(a.pending, id)
 }
 
-func (a *JsonAPI) Run() error {
-	p := make([]byte, MaxPacketSize)
+// resolvePending : hands reply to waiting call, returns false if nobody waits for it
+func (a *JsonAPI) resolvePending(packet RawPacket) bool {
+	a.pendingLock.Lock()
+	call, ok := a.pending[packet.ID]
+	delete(a.pending, packet.ID)
+	a.pendingLock.Unlock()
+
+	if !ok {
+		return false
+	}
+
+	if call.onReply != nil && packet.Error == "" {
+		call.onReply(packet)
+	}
+	call.reply <- packet
+
+	return true
+}
+
+// failPending : fails every call waiting for a reply with err
+func (a *JsonAPI) failPending(err error) {
+	a.pendingLock.Lock()
+	defer a.pendingLock.Unlock()
+
+	for id, call := range a.pending {
+		call.reply <- RawPacket{ID: id, failure: err}
+		delete(a.pending, id)
+	}
+}
+
+func (a *JsonAPI) onStateChange(state ConnectionState, err error) {
+	a.stateLock.Lock()
+	a.connected = state == StateConnected
+	if !a.connected {
+		a.lastRTT = 0
+	}
+	a.stateLock.Unlock()
+
+	// Queued messages wait for the next authentication
+	a.closeOutbox()
+
+	// Replies to calls made over a lost connection will never arrive
+	if state == StateDisconnected {
+		a.failPending(ErrConnectionLost)
+		a.stopSession()
+	}
+
+	// Every connection starts with default codec and no features until init negotiates them
+	if state == StateConnected {
+		a.setCodec(DefaultCodec)
+		a.setCapabilities(newCapabilities(0, nil))
+	}
+
+	a.eventChan <- &ConnectionStateEvent{
+		State: state,
+		Err:   err,
+	}
+}
+
+// SetHeartbeatInterval : sets delay between heartbeats, zero disables them. Takes effect on next Run
+func (a *JsonAPI) SetHeartbeatInterval(interval time.Duration) {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	a.heartbeatInterval = interval
+}
+
+// LastRTT : round-trip time of the last successful heartbeat on the current connection, zero if none
+func (a *JsonAPI) LastRTT() time.Duration {
+	a.stateLock.Lock()
+	defer a.stateLock.Unlock()
+
+	return a.lastRTT
+}
+
+// Heartbeat : sends heartbeat and records round-trip time of a successful reply. Only an unanswered
+// heartbeat is an error, an error reply still shows the controller is alive
+func (a *JsonAPI) Heartbeat(timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	var HeartbeatRequest struct {
+		Time int64 `json:"time"`
+	}
+
+	start := time.Now()
+	HeartbeatRequest.Time = start.Unix()
+
+	err := a.Call(ctx, "heartbeat", HeartbeatRequest, nil)
+	var remote *RemoteError
+	if errors.As(err, &remote) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	a.stateLock.Lock()
+	a.lastRTT = time.Since(start)
+	a.stateLock.Unlock()
+
+	return nil
+}
+
+// runHeartbeat : sends heartbeats while connected, resetting transport when one goes unanswered
+func (a *JsonAPI) runHeartbeat(stop chan struct{}) {
+	a.stateLock.Lock()
+	interval := a.heartbeatInterval
+	a.stateLock.Unlock()
+
+	if interval <= 0 {
+		return
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		_, err := a.transport.Read(p)
-		if err != nil {
-			return err
-		}
+		select {
+		case <-ticker.C:
+			a.stateLock.Lock()
+			connected := a.connected
+			a.stateLock.Unlock()
+
+			// Controllers without heartbeat support would never answer
+			if !connected || !a.Capabilities().Has(FeatureHeartbeat) {
+				continue
+			}
 
-		a.ParseMessage(p)
+			// Connection already dropped, resetting could only hit its replacement
+			err := a.Heartbeat(interval)
+			if err != nil && err != ErrConnectionLost {
+				if resetter, ok := a.transport.(Resetter); ok {
+					resetter.Reset(fmt.Errorf("heartbeat missed: %s", err))
+				}
+			}
+		case <-stop:
+			return
+		}
 	}
 }
 
-/*
-func ctrlRun(wg *sync.WaitGroup, stop signalCh) {
-	wg.Add(1)
-	go func() {
-		defer wg.Done()
-		for {
-			select {
-			case msg := <-ctrl.MessageChan("init"):
-				ctrlOnInitResponse(msg)
-			case <-stop:
-				return
+func (a *JsonAPI) callWithTimeout(kind string, req interface{}, resp interface{}) error {
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+
+	return a.Call(ctx, kind, req, resp)
+}
+
+// Init : starts connection handshake, negotiating protocol and requesting credentials if req.NodeID is empty
+func (a *JsonAPI) Init(req InitRequest) (InitResponse, error) {
+	var resp InitResponse
+
+	req.ProtocolVersion = ProtocolVersion
+	req.Codecs = SupportedCodecs()
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+
+	// Controller switches codec right after the reply, so has to the reading goroutine
+	err := a.call(ctx, "init", req, &resp, func(packet RawPacket) {
+		var negotiated InitResponse
+		if packet.codec.Unmarshal(packet.Data, &negotiated) == nil && negotiated.Codec != "" {
+			a.setCodec(negotiated.Codec)
+		}
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	// Only features both sides asked for are enabled
+	var features []string
+	for _, feature := range resp.Features {
+		for _, requested := range req.Features {
+			if feature == requested {
+				features = append(features, feature)
 			}
 		}
-	}()
+	}
+	a.setCapabilities(newCapabilities(resp.ProtocolVersion, features))
+
+	return resp, nil
+}
+
+// SetLegacyKeyAuth : allows authenticating controllers without FeatureChallengeAuth by sending the node key
+// itself. Off by default, feature list comes from an unsigned init reply anyone in the path can rewrite
+func (a *JsonAPI) SetLegacyKeyAuth(allow bool) {
+	a.sessionLock.Lock()
+	defer a.sessionLock.Unlock()
+
+	a.legacyKeyAuth = allow
 }
 
-func ctrlOnInitResponse(msg json.RawMessage) {
-	var InitResponse struct {
-		NodeID  string `json:"nodeId"`
-		NodeKey string `json:"nodeKey"`
+// Authenticate : authenticates node and waits for the controller verdict. With FeatureChallengeAuth the
+// node key never leaves the node, a still valid session token is tried first on reconnects. Without it
+// node key is only sent if legacy key authentication is enabled
+func (a *JsonAPI) Authenticate(nodeID string, nodeKey string) error {
+	if !a.Capabilities().Has(FeatureChallengeAuth) {
+		a.sessionLock.Lock()
+		legacy := a.legacyKeyAuth
+		a.sessionLock.Unlock()
+
+		if !legacy {
+			return fmt.Errorf("controller does not support challenge authentication, refusing to send node key")
+		}
+
+		_, err := a.authenticate(AuthRequest{
+			NodeID:  nodeID,
+			NodeKey: nodeKey,
+		})
+		return err
+	}
+
+	if token := a.sessionToken(nodeID); token != "" {
+		resp, err := a.authenticate(AuthRequest{
+			NodeID: nodeID,
+			Token:  token,
+		})
+		if err == nil {
+			a.startSession(nodeID, nodeKey, resp)
+			return nil
+		}
 	}
 
-	err := json.Unmarshal(msg, &InitResponse)
+	resp, err := a.challengeAuth(nodeID, nodeKey)
 	if err != nil {
-		log.Error().Str("msg", string(msg)).Msg("Error unmarshaling InitResponse")
-		return
+		return err
 	}
 
-	log.Info().
-		Str("NodeID", InitResponse.NodeID).
-		Str("NodeKey", InitResponse.NodeKey).
-		Msg("Received new node credentials")
+	a.startSession(nodeID, nodeKey, resp)
 
-	// Set newly acquired node id
-	config.Set("NodeID", InitResponse.NodeID)
-	config.Set("NodeKey", InitResponse.NodeKey)
-	WriteConfig()
+	return nil
 }
 
-func ctrlOnAuthResponse(msg json.RawMessage) {
-	var AuthResponse struct {
-		Success bool `json:"success"`
-	}
+func (a *JsonAPI) decodePacket(p []byte) (RawPacket, error) {
+	codec := a.currentCodec()
 
-	err := json.Unmarshal(msg, &AuthResponse)
+	packet, err := codec.DecodePacket(p)
 	if err != nil {
-		log.Error().Str("msg", string(msg)).Msg("Error unmarshaling AuthResponse")
-		return
+		return packet, fmt.Errorf("failed to unmarshal %s packet: %s", codec.Name(), err)
 	}
 
-	if AuthResponse.Success {
-		log.Info().Msg("Controller authentication successful")
-	} else {
-		log.Fatal().Msg("Controller authentication failed")
+	return packet, nil
+}
+
+func packetEvent(packet RawPacket) (Event, error) {
+	event := newEvent(packet.Type)
+	if event == nil {
+		return &UnknownEvent{
+			Type:  packet.Type,
+			Codec: packet.codec.Name(),
+			Data:  packet.Data,
+		}, nil
 	}
+
+	if len(packet.Data) > 0 {
+		err := packet.codec.Unmarshal(packet.Data, event)
+		if err != nil {
+			return nil, fmt.Errorf("failed to unmarshal %s packet data: %s", packet.Type, err)
+		}
+	}
+
+	return event, nil
 }
 
-func ctrlAuthRequest(nodeID string, nodeKey string) {
-	var AuthRequest struct {
-		NodeID  string `json:"nodeId"`
-		NodeKey string `json:"nodeKey"`
+// ParseMessage : decodes packet into event registered for its type
+func (a *JsonAPI) ParseMessage(p []byte) (Event, error) {
+	packet, err := a.decodePacket(p)
+	if err != nil {
+		return nil, err
 	}
 
-	AuthRequest.NodeID = nodeID
-	AuthRequest.NodeKey = nodeKey
+	return packetEvent(packet)
+}
+
+func (a *JsonAPI) Events() EventChannel {
+	return a.eventChan
+}
 
-	ctrl.SendMessage("auth", AuthRequest)
+// Run : reads packets, delivering replies to pending calls and everything else as events
+func (a *JsonAPI) Run() error {
+	stop := make(chan struct{})
+	defer close(stop)
+	go a.runHeartbeat(stop)
+
+	for {
+		p, err := a.transport.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		packet, err := a.decodePacket(p)
+		if err != nil {
+			a.eventChan <- &ErrorEvent{Err: err}
+			continue
+		}
+
+		if packet.ID != 0 && a.resolvePending(packet) {
+			continue
+		}
+
+		err = a.verifyPacket(packet)
+		if err != nil {
+			a.eventChan <- &SecurityEvent{
+				Type:   packet.Type,
+				Reason: err,
+			}
+			continue
+		}
+
+		event, err := packetEvent(packet)
+		if err != nil {
+			event = &ErrorEvent{Err: err}
+		}
+
+		a.eventChan <- event
+	}
 }
-*/
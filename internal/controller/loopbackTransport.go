@@ -0,0 +1,66 @@
+package controller
+
+import (
+	"sync"
+)
+
+// LoopbackTransport : in-process transport, messages written to one end are read from its peer
+type LoopbackTransport struct {
+	inbox chan []byte
+	peer  *LoopbackTransport
+
+	// shared by both ends, closing either end closes the pair
+	closeOnce *sync.Once
+	done      chan struct{}
+}
+
+// NewLoopbackPair : returns two connected transport ends
+func NewLoopbackPair() (*LoopbackTransport, *LoopbackTransport) {
+	closeOnce := &sync.Once{}
+	done := make(chan struct{})
+
+	a := &LoopbackTransport{
+		inbox:     make(chan []byte, eventQueueSize),
+		closeOnce: closeOnce,
+		done:      done,
+	}
+	b := &LoopbackTransport{
+		inbox:     make(chan []byte, eventQueueSize),
+		closeOnce: closeOnce,
+		done:      done,
+	}
+	a.peer, b.peer = b, a
+
+	return a, b
+}
+
+// ReadMessage : returns next message written by peer
+func (t *LoopbackTransport) ReadMessage() ([]byte, error) {
+	select {
+	case p := <-t.inbox:
+		return p, nil
+	case <-t.done:
+		return nil, ErrClosed
+	}
+}
+
+// WriteMessage : hands copy of p to peer
+func (t *LoopbackTransport) WriteMessage(p []byte) error {
+	message := append([]byte(nil), p...)
+
+	select {
+	case t.peer.inbox <- message:
+		return nil
+	case <-t.done:
+		return ErrClosed
+	}
+}
+
+// Close : closes both ends, pending and later reads and writes fail
+func (t *LoopbackTransport) Close() error {
+	t.closeOnce.Do(func() {
+		close(t.done)
+	})
+
+	return nil
+}
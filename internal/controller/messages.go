@@ -0,0 +1,61 @@
+package controller
+
+// messageRegistry : maps incoming packet types to event constructors. init and auth only ever arrive as
+// replies to calls, unsolicited ones are delivered as UnknownEvent
+var messageRegistry = map[string]func() Event{
+	"networkConfig":      func() Event { return &NetworkConfigEvent{} },
+	"networkConfigDelta": func() Event { return &NetworkConfigDeltaEvent{} },
+	"networkMembership":  func() Event { return &NetworkMembershipEvent{} },
+	"diagnosticRequest":  func() Event { return &DiagnosticRequestEvent{} },
+	"quarantine":         func() Event { return &QuarantineEvent{} },
+}
+
+// signedMessages : incoming packet types that change node configuration or run probes and have to be signed
+var signedMessages = map[string]bool{
+	"networkConfig":      true,
+	"networkConfigDelta": true,
+	"networkMembership":  true,
+	"diagnosticRequest":  true,
+	"quarantine":         true,
+}
+
+// RequireSignature : makes incoming packets of type rejected unless signed by a pinned controller key
+func RequireSignature(kind string) {
+	signedMessages[kind] = true
+}
+
+// RequiresSignature : whether incoming packets of type have to be signed
+func RequiresSignature(kind string) bool {
+	return signedMessages[kind]
+}
+
+// queuedMessages : outgoing message types kept in the outbox while the controller is unreachable
+var queuedMessages = map[string]bool{
+	"networkConfigResult": true,
+	"leaveNetwork":        true,
+}
+
+// QueueWhileOffline : makes outgoing messages of type wait in the outbox until the node is authenticated again
+func QueueWhileOffline(kind string) {
+	queuedMessages[kind] = true
+}
+
+// QueuedWhileOffline : whether outgoing messages of type are kept in the outbox while offline
+func QueuedWhileOffline(kind string) bool {
+	return queuedMessages[kind]
+}
+
+// RegisterMessage : registers event constructor for incoming packet type
+func RegisterMessage(kind string, factory func() Event) {
+	messageRegistry[kind] = factory
+}
+
+// newEvent : returns empty event for packet type, nil if type is unknown
+func newEvent(kind string) Event {
+	factory, ok := messageRegistry[kind]
+	if !ok {
+		return nil
+	}
+
+	return factory()
+}
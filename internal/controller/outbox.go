@@ -0,0 +1,236 @@
+package controller
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"time"
+)
+
+const (
+	// DefaultOutboxLimit : number of messages the outbox holds before refusing new ones
+	DefaultOutboxLimit = 256
+	// DefaultOutboxTTL : age after which queued messages are dropped instead of sent
+	DefaultOutboxTTL = 24 * time.Hour
+)
+
+// OutboxEntry : outgoing message waiting for the controller, data is kept JSON encoded
+// so that it survives restarts whatever codec gets negotiated
+type OutboxEntry struct {
+	Type   string          `json:"type"`
+	Data   json.RawMessage `json:"data"`
+	Queued time.Time       `json:"queued"`
+}
+
+// OutboxStore : persists queued messages, entries are saved in sending order
+type OutboxStore interface {
+	LoadOutbox() ([]OutboxEntry, error)
+	SaveOutbox(entries []OutboxEntry) error
+}
+
+// outbox : messages queued while offline, open once they have been flushed on an authenticated connection
+type outbox struct {
+	entries []OutboxEntry
+	store   OutboxStore
+	limit   int
+	ttl     time.Duration
+	open    bool
+	// expired : entries dropped since the last flush
+	expired int
+}
+
+// SetOutbox : sets where queued messages are persisted and how many are kept for how long.
+// Messages already persisted in store are queued ahead of any new one
+func (a *JsonAPI) SetOutbox(store OutboxStore, limit int, ttl time.Duration) error {
+	a.outboxLock.Lock()
+	defer a.outboxLock.Unlock()
+
+	if limit <= 0 {
+		limit = DefaultOutboxLimit
+	}
+	if ttl <= 0 {
+		ttl = DefaultOutboxTTL
+	}
+
+	a.outbox.store = store
+	a.outbox.limit = limit
+	a.outbox.ttl = ttl
+
+	if store == nil {
+		return nil
+	}
+
+	entries, err := store.LoadOutbox()
+	if err != nil {
+		return fmt.Errorf("error loading outbox: %s", err)
+	}
+	a.outbox.entries = append(entries, a.outbox.entries...)
+
+	return nil
+}
+
+// sendQueued : sends message directly while the outbox is open and empty, queues it otherwise
+func (a *JsonAPI) sendQueued(kind string, data interface{}) error {
+	a.outboxLock.Lock()
+	defer a.outboxLock.Unlock()
+
+	// Later messages must not overtake queued ones
+	if a.outbox.open && len(a.outbox.entries) == 0 {
+		err := a.send(Packet{
+			Type: kind,
+			Data: data,
+		})
+		if err == nil {
+			return nil
+		}
+	}
+
+	return a.enqueue(kind, data)
+}
+
+// enqueue : appends message to the outbox, caller holds the lock
+func (a *JsonAPI) enqueue(kind string, data interface{}) error {
+	buf, err := json.Marshal(data)
+	if err != nil {
+		return fmt.Errorf("failed to queue %s message: %s", kind, err)
+	}
+
+	a.expireOutbox()
+
+	if len(a.outbox.entries) >= a.outbox.limit {
+		return fmt.Errorf("outbox full, %s message dropped", kind)
+	}
+
+	a.outbox.entries = append(a.outbox.entries, OutboxEntry{
+		Type:   kind,
+		Data:   buf,
+		Queued: time.Now(),
+	})
+
+	return a.saveOutbox()
+}
+
+// expireOutbox : drops entries older than the outbox TTL, caller holds the lock
+func (a *JsonAPI) expireOutbox() {
+	var kept []OutboxEntry
+	for _, entry := range a.outbox.entries {
+		if time.Since(entry.Queued) < a.outbox.ttl {
+			kept = append(kept, entry)
+		}
+	}
+
+	a.outbox.expired += len(a.outbox.entries) - len(kept)
+	a.outbox.entries = kept
+}
+
+// saveOutbox : persists queued entries if a store is set, caller holds the lock
+func (a *JsonAPI) saveOutbox() error {
+	if a.outbox.store == nil {
+		return nil
+	}
+
+	err := a.outbox.store.SaveOutbox(a.outbox.entries)
+	if err != nil {
+		return fmt.Errorf("error saving outbox: %s", err)
+	}
+
+	return nil
+}
+
+// closeOutbox : queues further messages until the outbox is flushed on the next authenticated connection
+func (a *JsonAPI) closeOutbox() {
+	a.outboxLock.Lock()
+	defer a.outboxLock.Unlock()
+
+	a.outbox.open = false
+}
+
+// FlushOutbox : sends queued messages in order, then sends further messages directly until the connection
+// drops. Has to be called once the node is authenticated. Also returns how many expired messages were dropped
+// since the last complete flush
+func (a *JsonAPI) FlushOutbox() (sent int, expired int, err error) {
+	a.outboxLock.Lock()
+	defer a.outboxLock.Unlock()
+
+	a.expireOutbox()
+
+	for len(a.outbox.entries) > 0 {
+		entry := a.outbox.entries[0]
+
+		data, err := decodeJSONValue(entry.Data)
+		if err != nil {
+			// Entry would never be sendable, keeping it would block the rest
+			a.outbox.entries = a.outbox.entries[1:]
+			a.outbox.expired++
+			continue
+		}
+
+		err = a.send(Packet{
+			Type: entry.Type,
+			Data: data,
+		})
+		if err != nil {
+			saveErr := a.saveOutbox()
+			if saveErr != nil {
+				return sent, 0, fmt.Errorf("outbox flush failed: %s; %s", err, saveErr)
+			}
+			return sent, 0, fmt.Errorf("outbox flush failed: %s", err)
+		}
+
+		a.outbox.entries = a.outbox.entries[1:]
+		sent++
+	}
+
+	a.outbox.entries = nil
+	a.outbox.open = true
+	expired, a.outbox.expired = a.outbox.expired, 0
+
+	return sent, expired, a.saveOutbox()
+}
+
+// OutboxLength : number of messages waiting in the outbox
+func (a *JsonAPI) OutboxLength() int {
+	a.outboxLock.Lock()
+	defer a.outboxLock.Unlock()
+
+	return len(a.outbox.entries)
+}
+
+// decodeJSONValue : decodes queued data into plain values every codec can encode, keeping integers exact
+func decodeJSONValue(buf []byte) (interface{}, error) {
+	decoder := json.NewDecoder(bytes.NewReader(buf))
+	decoder.UseNumber()
+
+	var value interface{}
+	err := decoder.Decode(&value)
+	if err != nil {
+		return nil, err
+	}
+
+	return normalizeJSONNumbers(value), nil
+}
+
+func normalizeJSONNumbers(value interface{}) interface{} {
+	switch v := value.(type) {
+	case json.Number:
+		if i, err := v.Int64(); err == nil {
+			return i
+		}
+		if u, err := strconv.ParseUint(v.String(), 10, 64); err == nil {
+			return u
+		}
+		f, _ := v.Float64()
+		return f
+	case map[string]interface{}:
+		for key, item := range v {
+			v[key] = normalizeJSONNumbers(item)
+		}
+	case []interface{}:
+		for i, item := range v {
+			v[i] = normalizeJSONNumbers(item)
+		}
+	}
+
+	return value
+}
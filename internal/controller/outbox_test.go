@@ -0,0 +1,200 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+	"time"
+)
+
+// memoryOutboxStore : outbox store keeping the last saved entries
+type memoryOutboxStore struct {
+	entries []OutboxEntry
+}
+
+func (s *memoryOutboxStore) LoadOutbox() ([]OutboxEntry, error) {
+	return s.entries, nil
+}
+
+func (s *memoryOutboxStore) SaveOutbox(entries []OutboxEntry) error {
+	s.entries = append([]OutboxEntry(nil), entries...)
+	return nil
+}
+
+func newOutboxAPI(t *testing.T, store OutboxStore, limit int, ttl time.Duration) (*JsonAPI, *LoopbackTransport) {
+	node, peer := NewLoopbackPair()
+	t.Cleanup(func() { node.Close() })
+
+	api := NewJsonAPI(node).(*JsonAPI)
+	err := api.SetOutbox(store, limit, ttl)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return api, peer
+}
+
+// receivedResults : decodes versions of the next n networkConfigResult messages written to the peer
+func receivedResults(t *testing.T, peer *LoopbackTransport, n int) []uint64 {
+	var versions []uint64
+	for i := 0; i < n; i++ {
+		select {
+		case p := <-peer.inbox:
+			packet, err := GetCodec(DefaultCodec).DecodePacket(p)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if packet.Type != "networkConfigResult" {
+				t.Fatalf("received %s message, expected networkConfigResult", packet.Type)
+			}
+
+			var result NetworkConfigResult
+			err = packet.codec.Unmarshal(packet.Data, &result)
+			if err != nil {
+				t.Fatal(err)
+			}
+			versions = append(versions, result.Version)
+		case <-time.After(time.Second):
+			t.Fatalf("received %d of %d messages", i, n)
+		}
+	}
+
+	return versions
+}
+
+func queueResult(t *testing.T, api *JsonAPI, version uint64) {
+	err := api.SendMessage("networkConfigResult", NetworkConfigResult{NetworkID: "lab", Version: version})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestOutboxOrder(t *testing.T) {
+	store := &memoryOutboxStore{
+		entries: []OutboxEntry{
+			{Type: "networkConfigResult", Data: []byte(`{"networkId":"lab","version":1}`), Queued: time.Now()},
+		},
+	}
+	api, peer := newOutboxAPI(t, store, 0, 0)
+
+	// Queued until flushed on an authenticated connection
+	queueResult(t, api, 2)
+	queueResult(t, api, 3)
+	if len(peer.inbox) != 0 {
+		t.Fatalf("message sent before outbox was flushed")
+	}
+	if len(store.entries) != 3 {
+		t.Fatalf("%d entries persisted, expected 3", len(store.entries))
+	}
+
+	sent, expired, err := api.FlushOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 3 || expired != 0 {
+		t.Fatalf("sent %d expired %d, expected 3 and 0", sent, expired)
+	}
+
+	// Open outbox sends right away, after everything queued before
+	queueResult(t, api, 4)
+
+	versions := receivedResults(t, peer, 4)
+	for i, version := range versions {
+		if version != uint64(i+1) {
+			t.Fatalf("received versions %v, expected them in queued order", versions)
+		}
+	}
+	if len(store.entries) != 0 || api.OutboxLength() != 0 {
+		t.Fatalf("outbox not empty after flush")
+	}
+
+	// Lost connection closes outbox again
+	api.closeOutbox()
+	queueResult(t, api, 5)
+	if api.OutboxLength() != 1 {
+		t.Fatalf("message not queued after outbox was closed")
+	}
+}
+
+func TestOutboxTTL(t *testing.T) {
+	store := &memoryOutboxStore{
+		entries: []OutboxEntry{
+			{Type: "networkConfigResult", Data: []byte(`{"networkId":"lab","version":1}`), Queued: time.Now().Add(-2 * time.Hour)},
+			{Type: "networkConfigResult", Data: []byte(`{"networkId":"lab","version":2}`), Queued: time.Now().Add(-30 * time.Minute)},
+		},
+	}
+	api, peer := newOutboxAPI(t, store, 0, time.Hour)
+
+	// Expired entries are dropped when queueing too, and still counted on the next flush
+	queueResult(t, api, 3)
+	if api.OutboxLength() != 2 {
+		t.Fatalf("%d messages queued, expected 2", api.OutboxLength())
+	}
+
+	sent, expired, err := api.FlushOutbox()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if sent != 2 || expired != 1 {
+		t.Fatalf("sent %d expired %d, expected 2 and 1", sent, expired)
+	}
+
+	versions := receivedResults(t, peer, 2)
+	if versions[0] != 2 || versions[1] != 3 {
+		t.Fatalf("received versions %v, expected [2 3]", versions)
+	}
+
+	// Expired count is reset by a complete flush
+	_, expired, _ = api.FlushOutbox()
+	if expired != 0 {
+		t.Fatalf("expired messages counted twice")
+	}
+}
+
+func TestOutboxLimit(t *testing.T) {
+	store := &memoryOutboxStore{}
+	api, _ := newOutboxAPI(t, store, 2, 0)
+
+	queueResult(t, api, 1)
+	queueResult(t, api, 2)
+
+	err := api.SendMessage("networkConfigResult", NetworkConfigResult{NetworkID: "lab", Version: 3})
+	if err == nil || !strings.Contains(err.Error(), "outbox full") {
+		t.Fatalf("expected full outbox, got %v", err)
+	}
+	if api.OutboxLength() != 2 || len(store.entries) != 2 {
+		t.Fatalf("full outbox holds %d messages, %d persisted", api.OutboxLength(), len(store.entries))
+	}
+}
+
+// failingTransport : transport whose writes always fail
+type failingTransport struct{}
+
+func (failingTransport) ReadMessage() ([]byte, error) {
+	return nil, ErrClosed
+}
+
+func (failingTransport) WriteMessage(p []byte) error {
+	return ErrClosed
+}
+
+func TestOutboxFlushFailure(t *testing.T) {
+	store := &memoryOutboxStore{}
+	api := NewJsonAPI(failingTransport{}).(*JsonAPI)
+	err := api.SetOutbox(store, 0, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queueResult(t, api, 1)
+	queueResult(t, api, 2)
+
+	sent, _, err := api.FlushOutbox()
+	if err == nil || sent != 0 {
+		t.Fatalf("flush over closed transport sent %d, error %v", sent, err)
+	}
+
+	// Unsent messages stay queued for the next connection
+	if api.OutboxLength() != 2 || len(store.entries) != 2 {
+		t.Fatalf("%d messages queued, %d persisted after failed flush, expected 2", api.OutboxLength(), len(store.entries))
+	}
+}
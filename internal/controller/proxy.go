@@ -0,0 +1,64 @@
+package controller
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+)
+
+const (
+	// ProxyDirect : proxy setting that disables proxies, including ones from the environment
+	ProxyDirect = "direct"
+)
+
+// ProxyFunc : returns proxy selector for setting, either empty for HTTPS_PROXY/NO_PROXY from
+// environment, "direct", or a http:// or socks5:// URL with optional user:password
+func ProxyFunc(setting string) (func(*http.Request) (*url.URL, error), error) {
+	switch setting {
+	case "":
+		return http.ProxyFromEnvironment, nil
+	case ProxyDirect:
+		return func(*http.Request) (*url.URL, error) {
+			return nil, nil
+		}, nil
+	}
+
+	proxyURL, err := url.Parse(setting)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %s", err)
+	}
+
+	switch proxyURL.Scheme {
+	case "http", "socks5":
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme %s, use http or socks5", proxyURL.Scheme)
+	}
+
+	if proxyURL.Host == "" {
+		return nil, fmt.Errorf("proxy URL %s has no host", proxyURL.Redacted())
+	}
+
+	return http.ProxyURL(proxyURL), nil
+}
+
+// proxyFor : returns proxy that connection to websocket URL goes through, nil if direct
+func proxyFor(proxy func(*http.Request) (*url.URL, error), urlString string) (*url.URL, error) {
+	if proxy == nil {
+		return nil, nil
+	}
+
+	target, err := url.Parse(urlString)
+	if err != nil {
+		return nil, err
+	}
+
+	// Proxy selection works on the http equivalent of websocket schemes
+	switch target.Scheme {
+	case "ws":
+		target.Scheme = "http"
+	case "wss":
+		target.Scheme = "https"
+	}
+
+	return proxy(&http.Request{URL: target})
+}
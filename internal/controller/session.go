@@ -0,0 +1,190 @@
+package controller
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"time"
+)
+
+// tokenRefreshDivisor : session token is refreshed once this fraction of its lifetime is left
+const tokenRefreshDivisor = 5
+
+// session : short-lived token of the authenticated node, kept across reconnects
+type session struct {
+	nodeID   string
+	nodeKey  string
+	token    string
+	expires  time.Time
+	lifetime time.Duration
+	// stop : closed to end the refresh loop of the current connection
+	stop chan struct{}
+}
+
+// ChallengeMAC : returns hex HMAC-SHA256 keyed with node key over node id and controller nonce
+func ChallengeMAC(nodeKey string, nodeID string, nonce string) string {
+	mac := hmac.New(sha256.New, []byte(nodeKey))
+	mac.Write([]byte(nodeID))
+	mac.Write([]byte{0})
+	mac.Write([]byte(nonce))
+
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyChallengeMAC : checks MAC sent by node in constant time
+func VerifyChallengeMAC(nodeKey string, nodeID string, nonce string, mac string) bool {
+	expected := ChallengeMAC(nodeKey, nodeID, nonce)
+
+	return hmac.Equal([]byte(expected), []byte(mac))
+}
+
+// authenticate : sends auth request and checks verdict
+func (a *JsonAPI) authenticate(req AuthRequest) (AuthResponse, error) {
+	var resp AuthResponse
+
+	ctx, cancel := context.WithTimeout(context.Background(), DefaultCallTimeout)
+	defer cancel()
+
+	// Signed packets may follow the reply right away, recipient has to be known before they are read
+	err := a.call(ctx, "auth", req, &resp, func(packet RawPacket) {
+		var verdict AuthResponse
+		if packet.codec.Unmarshal(packet.Data, &verdict) == nil && verdict.Success {
+			a.setRecipient(req.NodeID)
+		}
+	})
+	if err != nil {
+		return resp, err
+	}
+
+	if !resp.Success {
+		return resp, fmt.Errorf("controller rejected authentication")
+	}
+
+	return resp, nil
+}
+
+// challengeAuth : proves possession of node key without sending it
+func (a *JsonAPI) challengeAuth(nodeID string, nodeKey string) (AuthResponse, error) {
+	var challenge AuthChallenge
+
+	err := a.callWithTimeout("authChallenge", AuthChallengeRequest{NodeID: nodeID}, &challenge)
+	if err != nil {
+		return AuthResponse{}, err
+	}
+
+	if challenge.Nonce == "" {
+		return AuthResponse{}, fmt.Errorf("controller sent empty authentication challenge")
+	}
+
+	return a.authenticate(AuthRequest{
+		NodeID: nodeID,
+		Nonce:  challenge.Nonce,
+		MAC:    ChallengeMAC(nodeKey, nodeID, challenge.Nonce),
+	})
+}
+
+// sessionToken : returns session token of node if it outlives the refresh margin, empty otherwise
+func (a *JsonAPI) sessionToken(nodeID string) string {
+	a.sessionLock.Lock()
+	defer a.sessionLock.Unlock()
+
+	s := a.session
+	if s.token == "" || s.nodeID != nodeID || time.Until(s.expires) < s.lifetime/tokenRefreshDivisor {
+		return ""
+	}
+
+	return s.token
+}
+
+func issuedToken(resp AuthResponse) bool {
+	return resp.Token != "" && resp.ExpiresIn > 0
+}
+
+// startSession : stores issued token and refreshes it for as long as the connection lasts
+func (a *JsonAPI) startSession(nodeID string, nodeKey string, resp AuthResponse) {
+	a.stopSession()
+
+	// Controllers may authenticate without issuing tokens
+	if !issuedToken(resp) {
+		return
+	}
+
+	lifetime := time.Duration(resp.ExpiresIn) * time.Second
+	stop := make(chan struct{})
+
+	a.sessionLock.Lock()
+	a.session = session{
+		nodeID:   nodeID,
+		nodeKey:  nodeKey,
+		token:    resp.Token,
+		expires:  time.Now().Add(lifetime),
+		lifetime: lifetime,
+		stop:     stop,
+	}
+	a.sessionLock.Unlock()
+
+	go a.refreshSession(stop)
+}
+
+// stopSession : ends refresh loop, token stays usable for reconnecting until it expires
+func (a *JsonAPI) stopSession() {
+	a.sessionLock.Lock()
+	defer a.sessionLock.Unlock()
+
+	if a.session.stop != nil {
+		close(a.session.stop)
+		a.session.stop = nil
+	}
+}
+
+// refreshSession : exchanges token before it expires, falling back to a new challenge
+func (a *JsonAPI) refreshSession(stop chan struct{}) {
+	for {
+		a.sessionLock.Lock()
+		s := a.session
+		a.sessionLock.Unlock()
+
+		timer := time.NewTimer(time.Until(s.expires) - s.lifetime/tokenRefreshDivisor)
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		var resp AuthResponse
+		err := a.callWithTimeout("authRefresh", TokenRefreshRequest{Token: s.token}, &resp)
+		if err == nil && (!resp.Success || !issuedToken(resp)) {
+			err = fmt.Errorf("controller refused token refresh")
+		}
+		if err != nil {
+			resp, err = a.challengeAuth(s.nodeID, s.nodeKey)
+			if err == nil && !issuedToken(resp) {
+				err = fmt.Errorf("controller issued no session token")
+			}
+		}
+		if err != nil {
+			a.eventChan <- &ErrorEvent{Err: fmt.Errorf("session token refresh failed: %s", err)}
+
+			// Connection is about to become unauthenticated, start over with a new login
+			if resetter, ok := a.transport.(Resetter); ok {
+				resetter.Reset(err)
+			}
+			return
+		}
+
+		lifetime := time.Duration(resp.ExpiresIn) * time.Second
+
+		a.sessionLock.Lock()
+		if a.session.stop != stop {
+			a.sessionLock.Unlock()
+			return
+		}
+		a.session.token = resp.Token
+		a.session.expires = time.Now().Add(lifetime)
+		a.session.lifetime = lifetime
+		a.sessionLock.Unlock()
+	}
+}
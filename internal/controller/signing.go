@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"encoding/base64"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const (
+	// signatureContext : prefix of signed bytes, keeps signatures from being valid in another context
+	signatureContext = "nodearmor-packet-v3"
+	// DefaultMaxClockSkew : tolerated difference between controller timestamp and local clock
+	DefaultMaxClockSkew = 5 * time.Minute
+	// unsignedController : replay store key of messages accepted without pinned keys
+	unsignedController = "unsigned"
+)
+
+// ReplayStore : last accepted sequence number per controller, persisted by the caller
+type ReplayStore interface {
+	LastSequence(controller string) uint64
+	SetLastSequence(controller string, seq uint64) error
+}
+
+// memoryReplayStore : replay store forgetting sequences on restart
+type memoryReplayStore struct {
+	lock      sync.Mutex
+	sequences map[string]uint64
+}
+
+// NewMemoryReplayStore : returns replay store kept in memory only
+func NewMemoryReplayStore() ReplayStore {
+	return &memoryReplayStore{
+		sequences: make(map[string]uint64),
+	}
+}
+
+func (s *memoryReplayStore) LastSequence(controller string) uint64 {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	return s.sequences[controller]
+}
+
+func (s *memoryReplayStore) SetLastSequence(controller string, seq uint64) error {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+
+	s.sequences[controller] = seq
+	return nil
+}
+
+// ParseSigningKey : decodes base64 Ed25519 public key
+func ParseSigningKey(s string) (ed25519.PublicKey, error) {
+	buf, err := base64.StdEncoding.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid signing key %s: %s", s, err)
+	}
+
+	if len(buf) != ed25519.PublicKeySize {
+		return nil, fmt.Errorf("invalid signing key %s: expected %d bytes, got %d", s, ed25519.PublicKeySize, len(buf))
+	}
+
+	return ed25519.PublicKey(buf), nil
+}
+
+// signedBytes : returns bytes covered by the signature of a packet with encoded data sent to node. Node id
+// keeps packets captured on the way to one node from being replayed to another
+func signedBytes(nodeID string, kind string, seq uint64, timestamp int64, data []byte) []byte {
+	buf := make([]byte, 0, len(signatureContext)+len(nodeID)+len(kind)+len(data)+19)
+	buf = append(buf, signatureContext...)
+	buf = append(buf, 0)
+	buf = append(buf, nodeID...)
+	buf = append(buf, 0)
+	buf = append(buf, kind...)
+	buf = append(buf, 0)
+	var numbers [16]byte
+	binary.BigEndian.PutUint64(numbers[:8], seq)
+	binary.BigEndian.PutUint64(numbers[8:], uint64(timestamp))
+	buf = append(buf, numbers[:]...)
+	buf = append(buf, data...)
+
+	return buf
+}
+
+// SignPacket : returns signature over recipient node id, packet type, sequence, timestamp and data as
+// encoded on the wire
+func SignPacket(key ed25519.PrivateKey, nodeID string, kind string, seq uint64, timestamp int64, data []byte) []byte {
+	return ed25519.Sign(key, signedBytes(nodeID, kind, seq, timestamp, data))
+}
+
+// setRecipient : sets node id signed packets have to be addressed to, known once node authenticated
+func (a *JsonAPI) setRecipient(nodeID string) {
+	a.signingLock.Lock()
+	defer a.signingLock.Unlock()
+
+	a.recipient = nodeID
+}
+
+// SetSigningKeys : pins controller keys, packets of types that require a signature are rejected unless one
+// of them signed it. Without keys they are rejected altogether unless unsigned controllers are allowed
+func (a *JsonAPI) SetSigningKeys(keys []ed25519.PublicKey) {
+	a.signingLock.Lock()
+	defer a.signingLock.Unlock()
+
+	a.signingKeys = append([]ed25519.PublicKey(nil), keys...)
+}
+
+// SetAllowUnsigned : accepts packets of types that require a signature unchecked while no key is pinned.
+// Only meant for test controllers, off by default
+func (a *JsonAPI) SetAllowUnsigned(allow bool) {
+	a.signingLock.Lock()
+	defer a.signingLock.Unlock()
+
+	a.allowUnsigned = allow
+}
+
+// SetReplayStore : sets where last accepted sequence numbers are kept, default forgets them on restart
+func (a *JsonAPI) SetReplayStore(store ReplayStore) {
+	a.signingLock.Lock()
+	defer a.signingLock.Unlock()
+
+	a.replayStore = store
+}
+
+// SetMaxClockSkew : sets tolerated difference between controller timestamps and local clock
+func (a *JsonAPI) SetMaxClockSkew(skew time.Duration) {
+	a.signingLock.Lock()
+	defer a.signingLock.Unlock()
+
+	a.maxSkew = skew
+}
+
+// verifyPacket : checks signature, sequence and timestamp of packet if its type requires a signature
+func (a *JsonAPI) verifyPacket(packet RawPacket) error {
+	if !RequiresSignature(packet.Type) {
+		return nil
+	}
+
+	a.signingLock.Lock()
+	keys, store, maxSkew, allowUnsigned, recipient := a.signingKeys, a.replayStore, a.maxSkew, a.allowUnsigned, a.recipient
+	a.signingLock.Unlock()
+
+	controller := unsignedController
+	if len(keys) > 0 {
+		if recipient == "" {
+			return fmt.Errorf("%s message received before authentication", packet.Type)
+		}
+
+		signer, err := verifySignature(keys, recipient, packet)
+		if err != nil {
+			return err
+		}
+		controller = base64.StdEncoding.EncodeToString(signer)
+	} else if !allowUnsigned {
+		return fmt.Errorf("%s message rejected, no controller signing key pinned", packet.Type)
+	} else if packet.Seq == 0 {
+		// Without pinned keys only controllers that send sequence numbers get replay checks
+		return nil
+	}
+
+	if packet.Seq == 0 || packet.Timestamp == 0 {
+		return fmt.Errorf("%s message without sequence number or timestamp", packet.Type)
+	}
+
+	if maxSkew <= 0 {
+		maxSkew = DefaultMaxClockSkew
+	}
+	skew := time.Since(time.Unix(0, packet.Timestamp*int64(time.Millisecond)))
+	if skew > maxSkew || skew < -maxSkew {
+		return fmt.Errorf("%s message timestamp off by %s", packet.Type, skew.Truncate(time.Second))
+	}
+
+	last := store.LastSequence(controller)
+	if packet.Seq <= last {
+		return fmt.Errorf("stale or duplicate %s message, sequence %d not after %d", packet.Type, packet.Seq, last)
+	}
+
+	err := store.SetLastSequence(controller, packet.Seq)
+	if err != nil {
+		return fmt.Errorf("error storing sequence of %s message: %s", packet.Type, err)
+	}
+
+	return nil
+}
+
+// verifySignature : returns key that signed packet for node
+func verifySignature(keys []ed25519.PublicKey, nodeID string, packet RawPacket) (ed25519.PublicKey, error) {
+	if len(packet.Signature) == 0 {
+		return nil, fmt.Errorf("unsigned %s message", packet.Type)
+	}
+
+	msg := signedBytes(nodeID, packet.Type, packet.Seq, packet.Timestamp, packet.Data)
+	for _, key := range keys {
+		if ed25519.Verify(key, msg, packet.Signature) {
+			return key, nil
+		}
+	}
+
+	return nil, fmt.Errorf("invalid signature on %s message", packet.Type)
+}
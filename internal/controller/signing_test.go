@@ -0,0 +1,203 @@
+package controller
+
+import (
+	"crypto/ed25519"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testNodeID : node the signing test API is authenticated as
+const testNodeID = "node"
+
+// signedPacket : returns networkConfig packet for testNodeID signed with key, sent at time sent
+func signedPacket(key ed25519.PrivateKey, seq uint64, sent time.Time) RawPacket {
+	return signedPacketFor(key, testNodeID, seq, sent)
+}
+
+// signedPacketFor : returns networkConfig packet for nodeID signed with key, sent at time sent
+func signedPacketFor(key ed25519.PrivateKey, nodeID string, seq uint64, sent time.Time) RawPacket {
+	data := []byte(`{"networkId":"lab"}`)
+	timestamp := sent.UnixNano() / int64(time.Millisecond)
+
+	return RawPacket{
+		Type:      "networkConfig",
+		Data:      data,
+		Seq:       seq,
+		Timestamp: timestamp,
+		Signature: SignPacket(key, nodeID, "networkConfig", seq, timestamp, data),
+		codec:     GetCodec(DefaultCodec),
+	}
+}
+
+func newSigningAPI(t *testing.T) (*JsonAPI, ed25519.PrivateKey) {
+	publicKey, key, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, _ := NewLoopbackPair()
+	api := NewJsonAPI(node).(*JsonAPI)
+	api.SetSigningKeys([]ed25519.PublicKey{publicKey})
+	api.SetMaxClockSkew(time.Minute)
+	api.setRecipient(testNodeID)
+
+	return api, key
+}
+
+func TestVerifyPacket(t *testing.T) {
+	now := time.Now()
+	_, otherKey, _ := ed25519.GenerateKey(nil)
+
+	tests := []struct {
+		name string
+		// accepted : sequence numbers accepted before packet is verified
+		accepted []uint64
+		packet   func(key ed25519.PrivateKey) RawPacket
+		// err : expected error substring, empty if packet is accepted
+		err string
+	}{
+		{
+			name:   "valid",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 1, now) },
+		},
+		{
+			name:   "small skew",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 1, now.Add(-30*time.Second)) },
+		},
+		{
+			name:   "timestamp too old",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 1, now.Add(-2*time.Minute)) },
+			err:    "timestamp off by",
+		},
+		{
+			name:   "timestamp in the future",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 1, now.Add(2*time.Minute)) },
+			err:    "timestamp off by",
+		},
+		{
+			name:     "later sequence",
+			accepted: []uint64{5},
+			packet:   func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 6, now) },
+		},
+		{
+			name:     "stale sequence",
+			accepted: []uint64{5},
+			packet:   func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 4, now) },
+			err:      "stale or duplicate networkConfig message, sequence 4 not after 5",
+		},
+		{
+			name:     "duplicate sequence",
+			accepted: []uint64{5},
+			packet:   func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 5, now) },
+			err:      "stale or duplicate networkConfig message, sequence 5 not after 5",
+		},
+		{
+			name:   "missing sequence",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacket(key, 0, now) },
+			err:    "without sequence number or timestamp",
+		},
+		{
+			name: "unsigned",
+			packet: func(key ed25519.PrivateKey) RawPacket {
+				packet := signedPacket(key, 1, now)
+				packet.Signature = nil
+				return packet
+			},
+			err: "unsigned networkConfig message",
+		},
+		{
+			name:   "unknown key",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacket(otherKey, 1, now) },
+			err:    "invalid signature",
+		},
+		{
+			name:   "other recipient",
+			packet: func(key ed25519.PrivateKey) RawPacket { return signedPacketFor(key, "other", 1, now) },
+			err:    "invalid signature",
+		},
+		{
+			name: "sequence changed after signing",
+			packet: func(key ed25519.PrivateKey) RawPacket {
+				packet := signedPacket(key, 1, now)
+				packet.Seq = 2
+				return packet
+			},
+			err: "invalid signature",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			api, key := newSigningAPI(t)
+
+			for _, seq := range test.accepted {
+				err := api.verifyPacket(signedPacket(key, seq, now))
+				if err != nil {
+					t.Fatalf("sequence %d rejected: %s", seq, err)
+				}
+			}
+
+			err := api.verifyPacket(test.packet(key))
+			if test.err == "" && err != nil {
+				t.Fatalf("packet rejected: %s", err)
+			}
+			if test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)) {
+				t.Fatalf("expected error containing %q, got %v", test.err, err)
+			}
+		})
+	}
+}
+
+func TestVerifyPacketReplay(t *testing.T) {
+	api, key := newSigningAPI(t)
+
+	packet := signedPacket(key, 1, time.Now())
+
+	err := api.verifyPacket(packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = api.verifyPacket(packet)
+	if err == nil {
+		t.Fatalf("replayed packet accepted")
+	}
+}
+
+func TestVerifyPacketBeforeAuth(t *testing.T) {
+	api, key := newSigningAPI(t)
+	api.setRecipient("")
+
+	// Recipient is unknown until authenticated, nothing to bind the signature to
+	err := api.verifyPacket(signedPacket(key, 1, time.Now()))
+	if err == nil || !strings.Contains(err.Error(), "before authentication") {
+		t.Fatalf("expected rejection before authentication, got %v", err)
+	}
+}
+
+func TestVerifyPacketWithoutKeys(t *testing.T) {
+	node, _ := NewLoopbackPair()
+	api := NewJsonAPI(node).(*JsonAPI)
+
+	_, key, _ := ed25519.GenerateKey(nil)
+	packet := signedPacket(key, 1, time.Now())
+
+	// Nothing to check signatures against, fails closed
+	err := api.verifyPacket(packet)
+	if err == nil || !strings.Contains(err.Error(), "no controller signing key pinned") {
+		t.Fatalf("expected rejection without pinned key, got %v", err)
+	}
+
+	api.SetAllowUnsigned(true)
+	err = api.verifyPacket(packet)
+	if err != nil {
+		t.Fatalf("packet rejected although unsigned controllers are allowed: %s", err)
+	}
+
+	// Types not requiring a signature are never checked
+	err = api.verifyPacket(RawPacket{Type: "status"})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,80 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+)
+
+// TLSOptions : TLS settings of the controller connection, empty fields keep system defaults
+type TLSOptions struct {
+	// CAFile : PEM bundle of CAs trusted instead of the system pool
+	CAFile string
+	// PinnedKeys : base64 SHA-256 hashes of trusted subject public key infos, one has to match the chain
+	PinnedKeys []string
+	// CertFile, KeyFile : PEM client certificate and key presented to the controller
+	CertFile string
+	KeyFile  string
+}
+
+// NewTLSConfig : builds TLS client configuration from options
+func NewTLSConfig(opts TLSOptions) (*tls.Config, error) {
+	tlsConfig := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+
+	if opts.CAFile != "" {
+		buf, err := ioutil.ReadFile(opts.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading CA file %s: %s", opts.CAFile, err)
+		}
+
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(buf) {
+			return nil, fmt.Errorf("no certificates found in CA file %s", opts.CAFile)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	if opts.CertFile != "" || opts.KeyFile != "" {
+		cert, err := tls.LoadX509KeyPair(opts.CertFile, opts.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %s", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+
+	if len(opts.PinnedKeys) > 0 {
+		pins := make(map[string]bool)
+		for _, pin := range opts.PinnedKeys {
+			hash, err := base64.StdEncoding.DecodeString(pin)
+			if err != nil || len(hash) != sha256.Size {
+				return nil, fmt.Errorf("invalid SPKI pin %s", pin)
+			}
+			pins[string(hash)] = true
+		}
+
+		tlsConfig.VerifyConnection = func(cs tls.ConnectionState) error {
+			return verifyPins(cs, pins)
+		}
+	}
+
+	return tlsConfig, nil
+}
+
+// verifyPins : checks that a certificate of the verified chain carries a pinned public key
+func verifyPins(cs tls.ConnectionState, pins map[string]bool) error {
+	for _, chain := range cs.VerifiedChains {
+		for _, cert := range chain {
+			hash := sha256.Sum256(cert.RawSubjectPublicKeyInfo)
+			if pins[string(hash[:])] {
+				return nil
+			}
+		}
+	}
+
+	return fmt.Errorf("controller certificate does not match any pinned key")
+}
@@ -1,9 +1,44 @@
 package controller
 
-import (
-	"io"
+// ConnectionState : state of the transport connection to the controller
+type ConnectionState int
+
+const (
+	StateDisconnected ConnectionState = iota
+	StateConnecting
+	StateConnected
 )
 
+func (s ConnectionState) String() string {
+	switch s {
+	case StateDisconnected:
+		return "disconnected"
+	case StateConnecting:
+		return "connecting"
+	case StateConnected:
+		return "connected"
+	default:
+		return "unknown"
+	}
+}
+
+// Transport : carries whole controller messages, preserving their boundaries
 type Transport interface {
-	io.ReadWriter
+	ReadMessage() ([]byte, error)
+	WriteMessage(p []byte) error
+}
+
+// StateNotifier : transport that reports connection state changes
+type StateNotifier interface {
+	SetStateHandler(handler func(state ConnectionState, err error))
+}
+
+// Resetter : transport that can be forced to drop and reestablish its connection
+type Resetter interface {
+	Reset(reason error)
+}
+
+// BinarySetter : transport that frames text and binary messages differently
+type BinarySetter interface {
+	SetBinary(binary bool)
 }
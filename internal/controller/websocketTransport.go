@@ -1,35 +1,109 @@
 package controller
 
 import (
+	"crypto/tls"
+	"errors"
 	"fmt"
+	"math/rand"
+	"net/http"
 	"net/url"
+	"strings"
+	"sync"
+	"time"
 
 	"github.com/gorilla/websocket"
 )
 
-// Controller : connects to a remote network controller
+const (
+	DefaultMinBackoff   = 1 * time.Second
+	DefaultMaxBackoff   = 60 * time.Second
+	DefaultPingInterval = 30 * time.Second
+	DefaultPongTimeout  = 60 * time.Second
+	DefaultFailback     = 60 * time.Second
+	closeTimeout        = 1 * time.Second
+	pingTimeout         = 5 * time.Second
+)
+
+var (
+	ErrNotConnected = errors.New("not connected")
+	ErrClosed       = errors.New("transport closed")
+)
+
+// WebsocketTransport : connects to a remote network controller, reconnecting when the connection drops
 type WebsocketTransport struct {
+	// MinBackoff : delay before first reconnection attempt, doubled on every failure
+	MinBackoff time.Duration
+	// MaxBackoff : upper bound of reconnection delay
+	MaxBackoff time.Duration
+	// PingInterval : delay between websocket pings
+	PingInterval time.Duration
+	// PongTimeout : read deadline, extended by every pong or message received
+	PongTimeout time.Duration
+	// TLSConfig : used for wss connections, nil for system defaults
+	TLSConfig *tls.Config
+	// Proxy : selects proxy for the controller URL, nil uses environment variables
+	Proxy func(*http.Request) (*url.URL, error)
+	// FailbackInterval : delay between probes of the primary endpoint while connected to another one
+	FailbackInterval time.Duration
+
+	lock            sync.Mutex
+	urls            []string
+	endpoint        string
 	websocketClient *websocket.Conn
+	closed          bool
+	binary          bool
+	done            chan struct{}
+	stateHandler    func(state ConnectionState, err error)
 }
 
-// Connect : connects to a controller server
-func (c *WebsocketTransport) Connect(urlString string) error {
-	url, err := url.Parse(urlString)
-	if err != nil {
-		return fmt.Errorf("URL parse failed: %s", err)
+// Connect : connects to the first reachable controller server in order of preference,
+// later reads reconnect to them if this attempt fails
+func (c *WebsocketTransport) Connect(urlStrings ...string) error {
+	if len(urlStrings) == 0 {
+		return fmt.Errorf("no controller URL")
 	}
 
-	c.websocketClient, _, err = websocket.DefaultDialer.Dial(url.String(), nil)
-	if err != nil {
-		return fmt.Errorf("WebsocketTransport connection failed: %s", err)
+	urls := make([]string, 0, len(urlStrings))
+	for _, urlString := range urlStrings {
+		url, err := url.Parse(urlString)
+		if err != nil {
+			return fmt.Errorf("URL parse failed: %s", err)
+		}
+		urls = append(urls, url.String())
 	}
-	defer c.websocketClient.Close()
 
-	return nil
+	c.lock.Lock()
+	c.urls = urls
+	c.closed = false
+	c.done = make(chan struct{})
+	c.lock.Unlock()
+
+	return c.dial()
 }
 
+// Disconnect : closes connection and stops reconnecting
 func (c *WebsocketTransport) Disconnect() error {
-	err := c.websocketClient.WriteMessage(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""))
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	if c.done != nil {
+		close(c.done)
+	}
+
+	if c.websocketClient == nil {
+		return nil
+	}
+	defer c.websocketClient.Close()
+
+	err := c.websocketClient.WriteControl(
+		websocket.CloseMessage,
+		websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+		time.Now().Add(closeTimeout),
+	)
 	if err != nil {
 		return fmt.Errorf("WebsocketTransport close failed: %s", err)
 	}
@@ -37,26 +111,315 @@ func (c *WebsocketTransport) Disconnect() error {
 	return nil
 }
 
-func (c *WebsocketTransport) Read(p []byte) (n int, err error) {
-	// Loop and skip non-text messages
+// SetStateHandler : sets function called on every connection state change
+func (c *WebsocketTransport) SetStateHandler(handler func(state ConnectionState, err error)) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.stateHandler = handler
+}
+
+func (c *WebsocketTransport) setState(state ConnectionState, err error) {
+	c.lock.Lock()
+	handler := c.stateHandler
+	c.lock.Unlock()
+
+	if handler != nil {
+		handler(state, err)
+	}
+}
+
+// Endpoint : returns URL of the controller currently connected to, empty while disconnected
+func (c *WebsocketTransport) Endpoint() string {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	return c.endpoint
+}
+
+// dial : connects to the first endpoint that accepts, trying them in order of preference
+func (c *WebsocketTransport) dial() error {
+	c.setState(StateConnecting, nil)
+
+	c.lock.Lock()
+	urls := c.urls
+	c.lock.Unlock()
+
+	var errs []string
+	for i, urlString := range urls {
+		conn, err := c.dialURL(urlString)
+		if err != nil {
+			errs = append(errs, err.Error())
+			continue
+		}
+
+		c.lock.Lock()
+		if c.closed {
+			c.lock.Unlock()
+			conn.Close()
+			return ErrClosed
+		}
+		c.websocketClient = conn
+		c.endpoint = urlString
+		done := c.done
+		c.lock.Unlock()
+
+		c.keepAlive(conn, done)
+		if i > 0 {
+			go c.failback(conn, done)
+		}
+		c.setState(StateConnected, nil)
+
+		return nil
+	}
+
+	err := errors.New(strings.Join(errs, "; "))
+	c.setState(StateDisconnected, err)
+
+	return err
+}
+
+// dialURL : opens websocket connection to a single endpoint
+func (c *WebsocketTransport) dialURL(urlString string) (*websocket.Conn, error) {
+	dialer := *websocket.DefaultDialer
+	dialer.TLSClientConfig = c.TLSConfig
+	if c.Proxy != nil {
+		dialer.Proxy = c.Proxy
+	}
+
+	proxyURL, err := proxyFor(dialer.Proxy, urlString)
+	if err != nil {
+		return nil, fmt.Errorf("WebsocketTransport proxy selection for %s failed: %s", urlString, err)
+	}
+
+	conn, _, err := dialer.Dial(urlString, nil)
+	if err != nil {
+		if proxyURL != nil {
+			return nil, fmt.Errorf("WebsocketTransport connection to %s through proxy %s failed: %s", urlString, proxyURL.Redacted(), err)
+		}
+		return nil, fmt.Errorf("WebsocketTransport connection to %s failed: %s", urlString, err)
+	}
+
+	return conn, nil
+}
+
+// failback : probes primary endpoint while conn to a fallback one is in use, dropping conn once primary accepts
+func (c *WebsocketTransport) failback(conn *websocket.Conn, done chan struct{}) {
+	interval := c.FailbackInterval
+	if interval <= 0 {
+		interval = DefaultFailback
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
 	for {
-		t, message, err := c.websocketClient.ReadMessage()
+		select {
+		case <-ticker.C:
+		case <-done:
+			return
+		}
+
+		c.lock.Lock()
+		current, primary := c.websocketClient, c.urls[0]
+		c.lock.Unlock()
+		if current != conn {
+			return
+		}
+
+		probe, err := c.dialURL(primary)
 		if err != nil {
-			return 0, err
+			continue
 		}
+		probe.WriteControl(
+			websocket.CloseMessage,
+			websocket.FormatCloseMessage(websocket.CloseNormalClosure, ""),
+			time.Now().Add(closeTimeout),
+		)
+		probe.Close()
 
-		if t == websocket.TextMessage {
-			p = message
-			return len(message), nil
+		// Reconnecting tries endpoints in order, starting with the primary
+		c.dropConnection(conn, fmt.Errorf("primary controller %s available again", primary))
+		return
+	}
+}
+
+func (c *WebsocketTransport) pingInterval() time.Duration {
+	if c.PingInterval <= 0 {
+		return DefaultPingInterval
+	}
+
+	return c.PingInterval
+}
+
+func (c *WebsocketTransport) pongTimeout() time.Duration {
+	if c.PongTimeout <= 0 {
+		return DefaultPongTimeout
+	}
+
+	// Deadline has to outlast at least one ping round
+	if c.PongTimeout <= c.pingInterval() {
+		return 2 * c.pingInterval()
+	}
+
+	return c.PongTimeout
+}
+
+// keepAlive : pings connection until it fails, reads time out if the other side goes silent
+func (c *WebsocketTransport) keepAlive(conn *websocket.Conn, done chan struct{}) {
+	pongTimeout := c.pongTimeout()
+
+	conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(pongTimeout))
+	})
+
+	go func() {
+		ticker := time.NewTicker(c.pingInterval())
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-ticker.C:
+				err := conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(pingTimeout))
+				if err != nil {
+					return
+				}
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Reset : drops current connection so that it gets reestablished
+func (c *WebsocketTransport) Reset(reason error) {
+	c.lock.Lock()
+	conn := c.websocketClient
+	c.lock.Unlock()
+
+	if conn != nil {
+		c.dropConnection(conn, reason)
+	}
+}
+
+// reconnect : dials until connected or closed, waiting with exponential backoff and jitter
+func (c *WebsocketTransport) reconnect() error {
+	minBackoff := c.MinBackoff
+	if minBackoff <= 0 {
+		minBackoff = DefaultMinBackoff
+	}
+	maxBackoff := c.MaxBackoff
+	if maxBackoff < minBackoff {
+		maxBackoff = DefaultMaxBackoff
+	}
+
+	backoff := minBackoff
+	for {
+		c.lock.Lock()
+		closed, done := c.closed, c.done
+		c.lock.Unlock()
+		if closed || done == nil {
+			return ErrClosed
+		}
+
+		// Wait between half and full backoff so nodes don't reconnect in lockstep
+		delay := backoff/2 + time.Duration(rand.Int63n(int64(backoff/2)+1))
+		select {
+		case <-time.After(delay):
+		case <-done:
+			return ErrClosed
+		}
+
+		err := c.dial()
+		if err == nil || err == ErrClosed {
+			return err
+		}
+
+		backoff *= 2
+		if backoff > maxBackoff {
+			backoff = maxBackoff
+		}
+	}
+}
+
+// dropConnection : discards broken connection unless it was already replaced
+func (c *WebsocketTransport) dropConnection(conn *websocket.Conn, err error) {
+	c.lock.Lock()
+	if c.websocketClient != conn || c.closed {
+		c.lock.Unlock()
+		return
+	}
+	c.websocketClient = nil
+	c.endpoint = ""
+	c.lock.Unlock()
+
+	conn.Close()
+	c.setState(StateDisconnected, err)
+}
+
+// SetBinary : sets whether messages are written as binary instead of text frames
+func (c *WebsocketTransport) SetBinary(binary bool) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+
+	c.binary = binary
+}
+
+// ReadMessage : returns next text or binary message, reconnecting on failure
+func (c *WebsocketTransport) ReadMessage() ([]byte, error) {
+	for {
+		c.lock.Lock()
+		conn, closed := c.websocketClient, c.closed
+		c.lock.Unlock()
+
+		if closed {
+			return nil, ErrClosed
+		}
+
+		if conn == nil {
+			err := c.reconnect()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		t, message, err := conn.ReadMessage()
+		if err != nil {
+			c.dropConnection(conn, err)
+			continue
+		}
+
+		conn.SetReadDeadline(time.Now().Add(c.pongTimeout()))
+
+		if t == websocket.TextMessage || t == websocket.BinaryMessage {
+			return message, nil
 		}
 	}
 }
 
-func (c *WebsocketTransport) Write(p []byte) (n int, err error) {
-	err = c.websocketClient.WriteMessage(websocket.TextMessage, p)
+// WriteMessage : sends p as a single text or binary message
+func (c *WebsocketTransport) WriteMessage(p []byte) error {
+	c.lock.Lock()
+	conn, binary := c.websocketClient, c.binary
+	c.lock.Unlock()
+
+	if conn == nil {
+		return ErrNotConnected
+	}
+
+	messageType := websocket.TextMessage
+	if binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	err := conn.WriteMessage(messageType, p)
 	if err != nil {
-		return 0, err
+		// Closing fails the pending read, which then takes care of reconnecting
+		conn.Close()
+		return err
 	}
 
-	return len(p), nil
+	return nil
 }
@@ -0,0 +1,634 @@
+// Package controllersim : local controller simulator that nodearmord instances can connect to
+package controllersim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/hex"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/internal/controller/fakecontroller"
+	"github.com/rs/zerolog"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	defaultListenAddr   = "localhost:8080"
+	defaultNetworksFile = "networks.yaml"
+)
+
+// simulator : serves controller protocol to nodes, keeping all state in memory
+type simulator struct {
+	// Codec : codec negotiated with nodes offering it, empty keeps default
+	Codec string
+	// TokenLifetime : lifetime of session tokens issued to nodes
+	TokenLifetime time.Duration
+	// SigningKey : signs configuration messages, nil sends them unsigned
+	SigningKey ed25519.PrivateKey
+	// Diagnostics : probes requested from every node once it authenticates
+	Diagnostics []controller.DiagnosticRequest
+	// Quarantine : sent to every node once it authenticates, nil sends nothing
+	Quarantine *controller.Quarantine
+
+	lock     sync.Mutex
+	networks map[string]*network
+	// tokens : enrollment tokens by token
+	tokens map[string]*enrollmentToken
+	// nodes : node keys by node id
+	nodes map[string]string
+	// sessions : authenticated connections by node id
+	sessions map[string]*fakecontroller.Controller
+	// sessionTokens : session tokens accepted on any connection
+	sessionTokens *fakecontroller.TokenStore
+}
+
+// newSimulator : returns simulator serving networks
+func newSimulator(networks map[string]*network) *simulator {
+	return &simulator{
+		networks: networks,
+		tokens:   make(map[string]*enrollmentToken),
+		nodes:    make(map[string]string),
+		sessions: make(map[string]*fakecontroller.Controller),
+
+		sessionTokens: fakecontroller.NewTokenStore(),
+		TokenLifetime: fakecontroller.DefaultTokenLifetime,
+	}
+}
+
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+// ServeHTTP : upgrades request to websocket and serves controller protocol until node disconnects
+func (s *simulator) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Error().Err(err).Msg("Websocket upgrade failed")
+		return
+	}
+	defer conn.Close()
+
+	log.Info().Str("remote", r.RemoteAddr).Msg("Node connected")
+
+	var nodeID string
+	session := s.newSession(&serverTransport{conn: conn}, &nodeID)
+
+	err = session.Run()
+
+	s.lock.Lock()
+	if nodeID != "" && s.sessions[nodeID] == session {
+		delete(s.sessions, nodeID)
+	}
+	s.lock.Unlock()
+
+	log.Info().Str("remote", r.RemoteAddr).Str("node", nodeID).Err(err).Msg("Node disconnected")
+}
+
+// newSession : returns fake controller whose handlers act on simulator state, nodeID is set once node authenticates
+func (s *simulator) newSession(t controller.Transport, nodeID *string) *fakecontroller.Controller {
+	session := fakecontroller.New(t)
+	session.Codec = s.Codec
+	session.Tokens = s.sessionTokens
+	session.TokenLifetime = s.TokenLifetime
+	session.SigningKey = s.SigningKey
+	session.Keys = func(id string) (string, bool) {
+		s.lock.Lock()
+		defer s.lock.Unlock()
+
+		key, ok := s.nodes[id]
+		return key, ok
+	}
+
+	// Credentials issued if this node turns out to be new
+	session.NodeID = randomHex(8)
+	session.NodeKey = randomHex(32)
+
+	initHandler := session.Handler("init")
+	session.Handle("init", func(req fakecontroller.Request) (interface{}, error) {
+		var init controller.InitRequest
+
+		err := req.Decode(&init)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := initHandler(req)
+		r, ok := resp.(controller.InitResponse)
+		if err != nil || !ok {
+			return resp, err
+		}
+
+		if r.NodeKey != "" {
+			s.lock.Lock()
+			s.nodes[r.NodeID] = r.NodeKey
+			s.lock.Unlock()
+
+			log.Info().Str("node", r.NodeID).Msg("Issued node credentials")
+		}
+
+		if init.EnrollmentToken != "" {
+			id := init.NodeID
+			if r.NodeID != "" {
+				id = r.NodeID
+			}
+
+			err = s.enroll(&r, id, init.EnrollmentToken)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		return r, nil
+	})
+
+	authHandler := session.Handler("auth")
+	session.Handle("auth", func(req fakecontroller.Request) (interface{}, error) {
+		var auth controller.AuthRequest
+
+		err := req.Decode(&auth)
+		if err != nil {
+			return nil, err
+		}
+
+		resp, err := authHandler(req)
+		r, ok := resp.(controller.AuthResponse)
+		if err != nil || !ok {
+			return resp, err
+		}
+
+		if r.Success {
+			s.lock.Lock()
+			*nodeID = auth.NodeID
+			s.sessions[auth.NodeID] = session
+			s.lock.Unlock()
+
+			// Bring reconnecting members up to date
+			go s.pushMemberships(auth.NodeID)
+			go s.requestDiagnostics(session, auth.NodeID)
+			go s.pushQuarantine(session, auth.NodeID)
+		}
+
+		method := "key"
+		if auth.Token != "" {
+			method = "token"
+		} else if auth.MAC != "" {
+			method = "challenge"
+		}
+		log.Info().Str("node", auth.NodeID).Str("method", method).Bool("success", r.Success).Msg("Node authentication")
+
+		return r, nil
+	})
+
+	session.Handle("networkConfigResult", func(req fakecontroller.Request) (interface{}, error) {
+		var result controller.NetworkConfigResult
+
+		err := req.Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		id := *nodeID
+		s.lock.Unlock()
+
+		log.Info().
+			Str("node", id).
+			Str("network", result.NetworkID).
+			Uint64("version", result.Version).
+			Bool("success", result.Success).
+			Str("hash", result.ConfigHash).
+			Int64("durationMs", result.DurationMs).
+			Str("error", result.Error).
+			Msg("Network configuration applied")
+
+		return nil, nil
+	})
+
+	session.Handle("status", func(req fakecontroller.Request) (interface{}, error) {
+		var status controller.StatusReport
+
+		err := req.Decode(&status)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		id := *nodeID
+		s.lock.Unlock()
+
+		log.Info().
+			Str("node", id).
+			Str("version", status.DaemonVersion).
+			Int64("uptime", status.UptimeSeconds).
+			Int("networks", len(status.Networks)).
+			Bool("quarantined", status.Quarantined).
+			Str("quarantineReason", status.QuarantineReason).
+			Msg("Node status")
+
+		for _, n := range status.Networks {
+			log.Debug().
+				Str("node", id).
+				Str("network", n.NetworkID).
+				Str("state", n.State).
+				Strs("addresses", n.Addresses).
+				Strs("peers", n.ReachablePeers).
+				Uint64("rx", n.RxBytes).
+				Uint64("tx", n.TxBytes).
+				Str("error", n.Error).
+				Msg("Network status")
+		}
+
+		return nil, nil
+	})
+
+	session.Handle("diagnosticResult", func(req fakecontroller.Request) (interface{}, error) {
+		var result controller.DiagnosticResult
+
+		err := req.Decode(&result)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		id := *nodeID
+		s.lock.Unlock()
+
+		log.Info().
+			Str("node", id).
+			Str("requestId", result.RequestID).
+			Str("probe", result.Probe).
+			Bool("success", result.Success).
+			Bool("truncated", result.Truncated).
+			Int64("durationMs", result.DurationMs).
+			Str("error", result.Error).
+			Msg("Diagnostic result")
+
+		if result.Output != "" {
+			fmt.Fprint(os.Stdout, result.Output)
+		}
+
+		return nil, nil
+	})
+
+	session.Handle("networkConfigResync", func(req fakecontroller.Request) (interface{}, error) {
+		var resync controller.NetworkConfigResync
+
+		err := req.Decode(&resync)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		id := *nodeID
+		s.lock.Unlock()
+
+		log.Info().Str("node", id).Str("network", resync.NetworkID).Uint64("version", resync.Version).Msg("Resync requested")
+
+		go s.pushConfig(resync.NetworkID, id)
+
+		return nil, nil
+	})
+
+	session.Handle("joinNetwork", func(req fakecontroller.Request) (interface{}, error) {
+		var join controller.JoinNetworkRequest
+
+		err := req.Decode(&join)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		id := *nodeID
+		n, ok := s.networks[join.NetworkID]
+		member := ok && n.member(id) >= 0
+		s.lock.Unlock()
+
+		if id == "" {
+			return nil, fmt.Errorf("not authenticated")
+		}
+		if !ok {
+			return nil, fmt.Errorf("network %s does not exist", join.NetworkID)
+		}
+
+		// Members, e.g. pre-approved by enrollment, only hand in their key
+		if member {
+			err = s.approve(n, id, join.PubKey)
+			if err != nil {
+				return nil, err
+			}
+
+			return controller.JoinNetworkResponse{Status: controller.MembershipApproved}, nil
+		}
+
+		if n.RejectJoins {
+			log.Info().Str("node", id).Str("network", n.ID).Msg("Join rejected")
+			return controller.JoinNetworkResponse{Status: controller.MembershipRejected}, nil
+		}
+
+		if n.ApprovalDelay > 0 {
+			log.Info().Str("node", id).Str("network", n.ID).Dur("delay", n.ApprovalDelay).Msg("Join pending")
+
+			time.AfterFunc(n.ApprovalDelay, func() {
+				err := s.approve(n, id, join.PubKey)
+				if err != nil {
+					log.Error().Err(err).Str("node", id).Str("network", n.ID).Msg("Error approving join")
+				}
+			})
+
+			return controller.JoinNetworkResponse{Status: controller.MembershipPending}, nil
+		}
+
+		err = s.approve(n, id, join.PubKey)
+		if err != nil {
+			return nil, err
+		}
+
+		return controller.JoinNetworkResponse{Status: controller.MembershipApproved}, nil
+	})
+
+	session.Handle("leaveNetwork", func(req fakecontroller.Request) (interface{}, error) {
+		var leave controller.LeaveNetworkRequest
+
+		err := req.Decode(&leave)
+		if err != nil {
+			return nil, err
+		}
+
+		s.lock.Lock()
+		id := *nodeID
+		n, ok := s.networks[leave.NetworkID]
+		if !ok {
+			s.lock.Unlock()
+			return nil, fmt.Errorf("network %s does not exist", leave.NetworkID)
+		}
+		delta, member := n.leave(id)
+		s.lock.Unlock()
+
+		if !member {
+			return nil, fmt.Errorf("node is not a member of network %s", leave.NetworkID)
+		}
+
+		log.Info().Str("node", id).Str("network", n.ID).Uint64("version", delta.Version).Msg("Node left")
+
+		go s.pushDelta(delta, id)
+
+		return nil, nil
+	})
+
+	return session
+}
+
+// enroll : spends token, binding node to its organisation and pre-approving it for the token networks
+func (s *simulator) enroll(resp *controller.InitResponse, nodeID string, tokenString string) error {
+	s.lock.Lock()
+	token, ok := s.tokens[tokenString]
+	if !ok || (token.UsedBy != "" && token.UsedBy != nodeID) {
+		s.lock.Unlock()
+		log.Warn().Str("node", nodeID).Msg("Invalid enrollment token")
+		return fmt.Errorf("invalid enrollment token")
+	}
+	token.UsedBy = nodeID
+
+	var deltas []controller.NetworkConfigDelta
+	for _, id := range token.Networks {
+		delta, err := s.networks[id].join(nodeID, "")
+		if err != nil {
+			s.lock.Unlock()
+			return err
+		}
+		deltas = append(deltas, delta)
+
+		resp.Networks = append(resp.Networks, controller.NetworkMembership{
+			NetworkID: id,
+			Status:    controller.MembershipApproved,
+		})
+	}
+	s.lock.Unlock()
+
+	resp.Organization = token.Organization
+
+	log.Info().Str("node", nodeID).Str("organization", token.Organization).Strs("networks", token.Networks).Msg("Node enrolled")
+
+	// Node itself receives configurations once it authenticates, and hands in its keys by joining the networks
+	go func() {
+		for _, delta := range deltas {
+			s.pushDelta(delta, nodeID)
+		}
+	}()
+
+	return nil
+}
+
+// approve : adds node to network and pushes the change to node and other members
+func (s *simulator) approve(n *network, nodeID string, pubKey string) error {
+	s.lock.Lock()
+	delta, err := n.join(nodeID, pubKey)
+	session, connected := s.sessions[nodeID]
+	s.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	log.Info().Str("node", nodeID).Str("network", n.ID).Uint64("version", delta.Version).Msg("Join approved")
+
+	go func() {
+		// Node that waited for approval learns about it through a push
+		if connected {
+			err := session.Push("networkMembership", controller.NetworkMembership{
+				NetworkID: n.ID,
+				Status:    controller.MembershipApproved,
+			})
+			if err != nil {
+				log.Error().Err(err).Str("node", nodeID).Msg("Error pushing network membership")
+			}
+		}
+
+		s.pushConfig(n.ID, nodeID)
+		s.pushDelta(delta, nodeID)
+	}()
+
+	return nil
+}
+
+// pushConfig : sends full network configuration to node if it is a connected member
+func (s *simulator) pushConfig(networkID string, nodeID string) {
+	s.lock.Lock()
+	n, ok := s.networks[networkID]
+	session, connected := s.sessions[nodeID]
+	if !ok || !connected || n.member(nodeID) < 0 {
+		s.lock.Unlock()
+		return
+	}
+	msg := n.config(nodeID)
+	s.lock.Unlock()
+
+	err := session.Push("networkConfig", msg)
+	if err != nil {
+		log.Error().Err(err).Str("network", networkID).Str("node", nodeID).Msg("Error pushing network configuration")
+	}
+}
+
+// pushDelta : sends configuration delta to every connected member except one
+func (s *simulator) pushDelta(delta controller.NetworkConfigDelta, exceptNodeID string) {
+	s.lock.Lock()
+	n, ok := s.networks[delta.NetworkID]
+	if !ok {
+		s.lock.Unlock()
+		return
+	}
+
+	var sessions []*fakecontroller.Controller
+	for _, node := range n.Nodes {
+		if session, ok := s.sessions[node.ID]; ok && node.ID != exceptNodeID {
+			sessions = append(sessions, session)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, session := range sessions {
+		err := session.Push("networkConfigDelta", delta)
+		if err != nil {
+			log.Error().Err(err).Str("network", delta.NetworkID).Msg("Error pushing network configuration delta")
+		}
+	}
+}
+
+// pushMemberships : sends configuration of every network node is member of
+func (s *simulator) pushMemberships(nodeID string) {
+	s.lock.Lock()
+	var networkIDs []string
+	for id, n := range s.networks {
+		if n.member(nodeID) >= 0 {
+			networkIDs = append(networkIDs, id)
+		}
+	}
+	s.lock.Unlock()
+
+	for _, id := range networkIDs {
+		s.pushConfig(id, nodeID)
+	}
+}
+
+// requestDiagnostics : sends configured diagnostic requests to node, each with its own request id
+func (s *simulator) requestDiagnostics(session *fakecontroller.Controller, nodeID string) {
+	for _, req := range s.Diagnostics {
+		req.RequestID = randomHex(8)
+
+		err := session.Push("diagnosticRequest", req)
+		if err != nil {
+			log.Error().Err(err).Str("node", nodeID).Str("probe", req.Probe).Msg("Error requesting diagnostic")
+			return
+		}
+		log.Info().Str("node", nodeID).Str("requestId", req.RequestID).Str("probe", req.Probe).Msg("Diagnostic requested")
+	}
+}
+
+// pushQuarantine : quarantines or releases node as configured
+func (s *simulator) pushQuarantine(session *fakecontroller.Controller, nodeID string) {
+	if s.Quarantine == nil {
+		return
+	}
+
+	err := session.Push("quarantine", *s.Quarantine)
+	if err != nil {
+		log.Error().Err(err).Str("node", nodeID).Msg("Error sending quarantine")
+		return
+	}
+	log.Info().Str("node", nodeID).Bool("release", s.Quarantine.Release).Str("reason", s.Quarantine.Reason).Msg("Quarantine sent")
+}
+
+// parseDiagnostics : parses comma separated probe[:network[:target]] list
+func parseDiagnostics(s string) []controller.DiagnosticRequest {
+	var requests []controller.DiagnosticRequest
+	for _, item := range strings.Split(s, ",") {
+		if item == "" {
+			continue
+		}
+
+		fields := strings.SplitN(item, ":", 3)
+		req := controller.DiagnosticRequest{Probe: fields[0]}
+		if len(fields) > 1 {
+			req.NetworkID = fields[1]
+		}
+		if len(fields) > 2 {
+			req.Target = fields[2]
+		}
+		requests = append(requests, req)
+	}
+
+	return requests
+}
+
+func randomHex(size int) string {
+	buf := make([]byte, size)
+	_, err := rand.Read(buf)
+	if err != nil {
+		panic(err)
+	}
+
+	return hex.EncodeToString(buf)
+}
+
+// Run : parses command line and serves simulator until it fails
+func Run() {
+	listenAddr := flag.String("listen", defaultListenAddr, "address to serve websocket protocol on")
+	networksFile := flag.String("networks", defaultNetworksFile, "YAML file with networks to serve")
+	codec := flag.String("codec", "", "codec to negotiate with nodes (json, cbor, msgpack)")
+	signingKey := flag.String("signing-key", "", "file with base64 Ed25519 seed signing configuration messages, created if missing")
+	diagnose := flag.String("diagnose", "", "comma separated probe[:network[:target]] list requested from every node once authenticated")
+	quarantine := flag.String("quarantine", "", "reason to quarantine every node with once authenticated")
+	release := flag.Bool("release", false, "release every node from quarantine once authenticated")
+	tokenLifetime := flag.Duration("token-lifetime", fakecontroller.DefaultTokenLifetime, "lifetime of session tokens issued to nodes")
+	flag.Parse()
+
+	// Setup logs
+	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
+
+	networks, tokens, err := loadNetworks(*networksFile)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error loading networks")
+	}
+
+	sim := newSimulator(networks)
+	sim.tokens = tokens
+	sim.Codec = *codec
+	sim.TokenLifetime = *tokenLifetime
+	sim.Diagnostics = parseDiagnostics(*diagnose)
+	if *release {
+		sim.Quarantine = &controller.Quarantine{Release: true}
+	} else if *quarantine != "" {
+		sim.Quarantine = &controller.Quarantine{Reason: *quarantine}
+	}
+
+	if *signingKey != "" {
+		sim.SigningKey, err = loadSigningKey(*signingKey)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Error loading signing key")
+		}
+
+		publicKey := sim.SigningKey.Public().(ed25519.PublicKey)
+		log.Info().
+			Str("publicKey", base64.StdEncoding.EncodeToString(publicKey)).
+			Msg("Signing configuration messages, pin public key in ControllerSigningKeys")
+	} else {
+		log.Warn().Msg("Sending configuration messages unsigned, nodes only accept them with AllowUnsignedController set")
+	}
+
+	log.Info().Str("addr", *listenAddr).Int("networks", len(networks)).Msg("Serving controller simulator")
+
+	err = http.ListenAndServe(*listenAddr, sim)
+	if err != nil {
+		log.Fatal().Err(err).Msg("Error serving controller simulator")
+	}
+}
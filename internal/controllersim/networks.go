@@ -0,0 +1,306 @@
+package controllersim
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"gopkg.in/yaml.v2"
+)
+
+// networksFile : YAML document with networks served by the simulator
+type networksFile struct {
+	Networks         []networkDefinition `yaml:"networks"`
+	EnrollmentTokens []tokenDefinition   `yaml:"enrollmentTokens"`
+}
+
+// tokenDefinition : one-time enrollment token as written in the YAML file
+type tokenDefinition struct {
+	Token        string   `yaml:"token"`
+	Organization string   `yaml:"organization"`
+	Networks     []string `yaml:"networks"`
+}
+
+// enrollmentToken : token binding nodes to an organisation and pre-approving them for networks
+type enrollmentToken struct {
+	Organization string
+	Networks     []string
+	// UsedBy : node that spent the token, empty while unused
+	UsedBy string
+}
+
+// networkDefinition : network as written in the YAML file
+type networkDefinition struct {
+	ID          string `yaml:"id"`
+	Kind        string `yaml:"kind"`
+	Subnet      string `yaml:"subnet"`
+	RejectJoins bool   `yaml:"rejectJoins"`
+	// ApprovalDelay : keeps joins pending for this long before approving them
+	ApprovalDelay string            `yaml:"approvalDelay"`
+	Routes        []routeDefinition `yaml:"routes"`
+	Nodes         []nodeDefinition  `yaml:"nodes"`
+}
+
+type routeDefinition struct {
+	Route   string `yaml:"route"`
+	Gateway string `yaml:"gateway"`
+}
+
+type nodeDefinition struct {
+	ID         string   `yaml:"id"`
+	Name       string   `yaml:"name"`
+	PrivateIPs []string `yaml:"privateIPs"`
+	PublicIPs  []string `yaml:"publicIPs"`
+	PubKey     string   `yaml:"pubKey"`
+}
+
+// network : simulated network, nodes that join are appended to its members
+type network struct {
+	ID            string
+	Kind          string
+	Version       uint64
+	RejectJoins   bool
+	ApprovalDelay time.Duration
+	Subnet        *net.IPNet
+	Routes        []vpn.RouteConfig
+	Nodes         []vpn.NodeConfig
+}
+
+// loadNetworks : reads networks and enrollment tokens from YAML file
+func loadNetworks(filePath string) (map[string]*network, map[string]*enrollmentToken, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error reading networks file %s: %s", filePath, err)
+	}
+
+	var file networksFile
+	err = yaml.UnmarshalStrict(buf, &file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error parsing networks file %s: %s", filePath, err)
+	}
+
+	networks := make(map[string]*network)
+	for _, definition := range file.Networks {
+		n, err := definition.network()
+		if err != nil {
+			return nil, nil, fmt.Errorf("network %s: %s", definition.ID, err)
+		}
+		networks[n.ID] = n
+	}
+
+	tokens := make(map[string]*enrollmentToken)
+	for _, definition := range file.EnrollmentTokens {
+		if definition.Token == "" {
+			return nil, nil, fmt.Errorf("enrollment token without token")
+		}
+		for _, id := range definition.Networks {
+			if _, ok := networks[id]; !ok {
+				return nil, nil, fmt.Errorf("enrollment token grants unknown network %s", id)
+			}
+		}
+		tokens[definition.Token] = &enrollmentToken{
+			Organization: definition.Organization,
+			Networks:     definition.Networks,
+		}
+	}
+
+	return networks, tokens, nil
+}
+
+func (d networkDefinition) network() (*network, error) {
+	if d.ID == "" {
+		return nil, fmt.Errorf("missing id")
+	}
+
+	n := &network{
+		ID:          d.ID,
+		Kind:        d.Kind,
+		Version:     1,
+		RejectJoins: d.RejectJoins,
+	}
+	if n.Kind == "" {
+		n.Kind = "tinc"
+	}
+
+	if d.ApprovalDelay != "" {
+		delay, err := time.ParseDuration(d.ApprovalDelay)
+		if err != nil {
+			return nil, fmt.Errorf("invalid approval delay: %s", err)
+		}
+		n.ApprovalDelay = delay
+	}
+
+	if d.Subnet != "" {
+		_, subnet, err := net.ParseCIDR(d.Subnet)
+		if err != nil {
+			return nil, fmt.Errorf("invalid subnet: %s", err)
+		}
+		n.Subnet = subnet
+	}
+
+	for _, r := range d.Routes {
+		_, route, err := net.ParseCIDR(r.Route)
+		if err != nil {
+			return nil, fmt.Errorf("invalid route %s: %s", r.Route, err)
+		}
+
+		gateway := net.IPv4zero
+		if r.Gateway != "" {
+			gateway = net.ParseIP(r.Gateway)
+			if gateway == nil {
+				return nil, fmt.Errorf("invalid gateway %s", r.Gateway)
+			}
+		}
+
+		n.Routes = append(n.Routes, vpn.RouteConfig{
+			Route:   *route,
+			Gateway: gateway,
+		})
+	}
+
+	for _, nd := range d.Nodes {
+		node := vpn.NodeConfig{
+			ID:     nd.ID,
+			Name:   nd.Name,
+			PubKey: nd.PubKey,
+		}
+
+		for _, s := range nd.PrivateIPs {
+			ip, ipNet, err := net.ParseCIDR(s)
+			if err != nil {
+				return nil, fmt.Errorf("node %s: invalid private IP %s: %s", nd.ID, s, err)
+			}
+			ipNet.IP = ip
+			node.PrivateIPs = append(node.PrivateIPs, *ipNet)
+		}
+
+		for _, s := range nd.PublicIPs {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("node %s: invalid public IP %s", nd.ID, s)
+			}
+			node.PublicIPs = append(node.PublicIPs, ip)
+		}
+
+		n.Nodes = append(n.Nodes, node)
+	}
+
+	return n, nil
+}
+
+// member : returns index of node in network, -1 if it is not a member
+func (n *network) member(nodeID string) int {
+	for i, node := range n.Nodes {
+		if node.ID == nodeID {
+			return i
+		}
+	}
+
+	return -1
+}
+
+// join : adds node to network, allocating next free address of the subnet. Returns delta for other members
+func (n *network) join(nodeID string, pubKey string) (controller.NetworkConfigDelta, error) {
+	delta := controller.NetworkConfigDelta{
+		NetworkID:   n.ID,
+		BaseVersion: n.Version,
+		Version:     n.Version + 1,
+	}
+
+	if i := n.member(nodeID); i >= 0 {
+		if pubKey != "" {
+			n.Nodes[i].PubKey = pubKey
+		}
+		delta.UpdateNodes = []vpn.NodeConfig{n.Nodes[i]}
+		n.Version++
+		return delta, nil
+	}
+
+	node := vpn.NodeConfig{
+		ID:     nodeID,
+		Name:   nodeID,
+		PubKey: pubKey,
+	}
+
+	if n.Subnet != nil {
+		ip, err := n.freeIP()
+		if err != nil {
+			return delta, err
+		}
+		node.PrivateIPs = []net.IPNet{{IP: ip, Mask: n.Subnet.Mask}}
+	}
+
+	n.Nodes = append(n.Nodes, node)
+	delta.AddNodes = []vpn.NodeConfig{node}
+	n.Version++
+
+	return delta, nil
+}
+
+// leave : removes node from network. Returns delta for remaining members and whether node was a member
+func (n *network) leave(nodeID string) (controller.NetworkConfigDelta, bool) {
+	i := n.member(nodeID)
+	if i < 0 {
+		return controller.NetworkConfigDelta{}, false
+	}
+
+	delta := controller.NetworkConfigDelta{
+		NetworkID:   n.ID,
+		BaseVersion: n.Version,
+		Version:     n.Version + 1,
+		RemoveNodes: []string{nodeID},
+	}
+
+	n.Nodes = append(n.Nodes[:i], n.Nodes[i+1:]...)
+	n.Version++
+
+	return delta, true
+}
+
+// freeIP : returns lowest subnet host address no member uses
+func (n *network) freeIP() (net.IP, error) {
+	used := make(map[string]bool)
+	for _, node := range n.Nodes {
+		for _, ipNet := range node.PrivateIPs {
+			used[ipNet.IP.String()] = true
+		}
+	}
+
+	ip := make(net.IP, len(n.Subnet.IP))
+	copy(ip, n.Subnet.IP)
+
+	for {
+		// Increment address, skipping network address
+		for i := len(ip) - 1; i >= 0; i-- {
+			ip[i]++
+			if ip[i] != 0 {
+				break
+			}
+		}
+
+		if !n.Subnet.Contains(ip) {
+			return nil, fmt.Errorf("subnet %s exhausted", n.Subnet)
+		}
+
+		if !used[ip.String()] {
+			return ip, nil
+		}
+	}
+}
+
+// config : returns network configuration as seen by node
+func (n *network) config(selfID string) controller.NetworkConfig {
+	return controller.NetworkConfig{
+		NetworkID: n.ID,
+		Kind:      n.Kind,
+		Version:   n.Version,
+		Config: vpn.NetworkConfig{
+			Nodes:  append([]vpn.NodeConfig(nil), n.Nodes...),
+			SelfID: selfID,
+			Routes: n.Routes,
+		},
+	}
+}
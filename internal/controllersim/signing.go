@@ -0,0 +1,39 @@
+package controllersim
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+// loadSigningKey : reads base64 Ed25519 seed from file, generating and writing a new one if it does not exist
+func loadSigningKey(filePath string) (ed25519.PrivateKey, error) {
+	buf, err := ioutil.ReadFile(filePath)
+	if os.IsNotExist(err) {
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			return nil, fmt.Errorf("error generating signing key: %s", err)
+		}
+
+		err = ioutil.WriteFile(filePath, []byte(base64.StdEncoding.EncodeToString(key.Seed())+"\n"), 0600)
+		if err != nil {
+			return nil, fmt.Errorf("error writing signing key %s: %s", filePath, err)
+		}
+
+		return key, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading signing key %s: %s", filePath, err)
+	}
+
+	seed, err := base64.StdEncoding.DecodeString(strings.TrimSpace(string(buf)))
+	if err != nil || len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("signing key %s is not a base64 Ed25519 seed", filePath)
+	}
+
+	return ed25519.NewKeyFromSeed(seed), nil
+}
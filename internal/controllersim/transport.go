@@ -0,0 +1,50 @@
+package controllersim
+
+import (
+	"sync"
+
+	"github.com/gorilla/websocket"
+)
+
+// serverTransport : controller side of a node websocket connection
+type serverTransport struct {
+	conn *websocket.Conn
+
+	lock   sync.Mutex
+	binary bool
+}
+
+// ReadMessage : returns next text or binary message
+func (t *serverTransport) ReadMessage() ([]byte, error) {
+	for {
+		messageType, message, err := t.conn.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+
+		if messageType == websocket.TextMessage || messageType == websocket.BinaryMessage {
+			return message, nil
+		}
+	}
+}
+
+// WriteMessage : sends p as a single text or binary message
+func (t *serverTransport) WriteMessage(p []byte) error {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	messageType := websocket.TextMessage
+	if t.binary {
+		messageType = websocket.BinaryMessage
+	}
+
+	return t.conn.WriteMessage(messageType, p)
+}
+
+// SetBinary : sets whether messages are written as binary instead of text frames
+func (t *serverTransport) SetBinary(binary bool) {
+	t.lock.Lock()
+	defer t.lock.Unlock()
+
+	t.binary = binary
+}
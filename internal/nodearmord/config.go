@@ -1,12 +1,17 @@
 package nodearmord
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
 	"os"
 	"os/user"
 	"path/filepath"
 
+	"github.com/nodearmor/daemon/pkg/vpn"
 	"github.com/spf13/viper"
 )
 
@@ -14,27 +19,77 @@ const (
 	appName              = "nodearmor"
 	configFileName       = "settings"
 	defaultControllerURL = "wss://api.nodearmor.net/"
+	defaultPingInterval  = "30s"
+	defaultPongTimeout   = "60s"
+	defaultHeartbeat     = "30s"
+	defaultStatus        = "60s"
+	defaultStatusCheck   = "5s"
+	defaultFailback      = "60s"
+	defaultMaxClockSkew  = "5m"
+	defaultOutboxLimit   = 256
+	defaultOutboxTTL     = "24h"
+	defaultDiagnosticMax = 64 * 1024
+	defaultVPNKind       = "tinc"
+	tincDirName          = "tinc"
 )
 
 // Config : global configuration store
 var config = viper.New()
 
+// configDir : directory holding configuration and local state files
+var configDir string
+
 // LoadConfig : initializes defaults and loads configuration from file if present
 func LoadConfig() {
 	// Config settings
 	config.SetConfigType("json")
 	config.SetConfigName(configFileName)
 
-	// Config dirs
-	usr, err := user.Current()
-	configDir := filepath.Join(usr.HomeDir, fmt.Sprintf(".%s", appName))
-	_ = os.Mkdir(configDir, os.ModeDir)
+	// Config dirs, ~/.nodearmor unless set on the command line
+	if configDir == "" {
+		usr, err := user.Current()
+		if err != nil {
+			log.Fatalf("error finding home directory: %s", err)
+		}
+		configDir = filepath.Join(usr.HomeDir, fmt.Sprintf(".%s", appName))
+	}
+	_ = os.MkdirAll(configDir, 0700)
 	config.AddConfigPath(configDir)
 
-	// Set defaults
-	config.SetDefault("ControllerURL", defaultControllerURL)
+	// Set defaults. ControllerURL also accepts a list of URLs in order of preference, when empty
+	// controllers are discovered from ControllerDomain, falling back to defaultControllerURL
+	config.SetDefault("ControllerURL", "")
+	config.SetDefault("ControllerDomain", "")
+	config.SetDefault("ControllerDNSServer", "")
+	config.SetDefault("ControllerFailbackInterval", defaultFailback)
+	config.SetDefault("PingInterval", defaultPingInterval)
+	config.SetDefault("PongTimeout", defaultPongTimeout)
+	config.SetDefault("HeartbeatInterval", defaultHeartbeat)
+	config.SetDefault("ControllerCAFile", "")
+	config.SetDefault("ControllerPinnedKeys", []string{})
+	config.SetDefault("ControllerCertFile", "")
+	config.SetDefault("ControllerKeyFile", "")
+	config.SetDefault("ControllerProxy", "")
+	// Sends node key itself to controllers that do not offer challenge authentication
+	config.SetDefault("AllowLegacyKeyAuth", false)
+	config.SetDefault("ControllerSigningKeys", []string{})
+	// Accepts unsigned configuration messages while no signing key is pinned, for test controllers only
+	config.SetDefault("AllowUnsignedController", false)
+	config.SetDefault("ControllerMaxClockSkew", defaultMaxClockSkew)
+	config.SetDefault("OutboxLimit", defaultOutboxLimit)
+	config.SetDefault("OutboxTTL", defaultOutboxTTL)
+	// Diagnostic probes the controller may run, none unless listed
+	config.SetDefault("DiagnosticProbes", []string{})
+	config.SetDefault("DiagnosticMaxOutput", defaultDiagnosticMax)
+	// VPN backend of networks created on join, before the controller sends their configuration
+	config.SetDefault("VPNKind", defaultVPNKind)
+	// RPC is unauthenticated, keep it on a loopback address
+	config.SetDefault("RPCAddress", net.JoinHostPort(RPCHost, fmt.Sprint(RPCPort)))
+	config.SetDefault("EnrollmentToken", "")
+	config.SetDefault("StatusInterval", defaultStatus)
+	config.SetDefault("StatusCheckInterval", defaultStatusCheck)
 
-	err = config.ReadInConfig()
+	err := config.ReadInConfig()
 	if err != nil {
 		log.Print("configuration file not found. Creating default.")
 
@@ -56,3 +111,30 @@ func WriteConfig() {
 
 	log.Print("config file written")
 }
+
+// separateVPNInstance : keeps tinc networks in configDir, their services and interfaces named after a hash
+// of it, so daemons started with their own -config-dir can join the same network on one host
+func separateVPNInstance() {
+	dir, err := filepath.Abs(configDir)
+	if err != nil {
+		log.Fatalf("error resolving config directory: %s", err)
+	}
+
+	sum := sha256.Sum256([]byte(dir))
+	err = vpn.SetTincInstance(hex.EncodeToString(sum[:4]), filepath.Join(dir, tincDirName))
+	if err != nil {
+		log.Fatalf("error separating tinc networks: %s", err)
+	}
+}
+
+// writeFileAtomic : replaces local state file through a temporary file, so readers never see it half written
+func writeFileAtomic(path string, buf []byte) error {
+	tmp := path + ".tmp"
+
+	err := ioutil.WriteFile(tmp, buf, 0600)
+	if err != nil {
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
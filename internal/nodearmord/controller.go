@@ -0,0 +1,235 @@
+package nodearmord
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"github.com/rs/zerolog/log"
+)
+
+// HandleControllerEvents : dispatches events received from the controller
+func HandleControllerEvents(wg *sync.WaitGroup, stop signalCh) {
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case event := <-ctrl.Events():
+				ctrlOnEvent(event)
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+func ctrlOnEvent(event controller.Event) {
+	switch e := event.(type) {
+	case *controller.ConnectionStateEvent:
+		ctrlOnConnectionState(e)
+	case *controller.NetworkConfigEvent:
+		ctrlOnNetworkConfig(e)
+	case *controller.NetworkConfigDeltaEvent:
+		ctrlOnNetworkConfigDelta(e)
+	case *controller.NetworkMembershipEvent:
+		ctrlOnNetworkMembership(e)
+	case *controller.DiagnosticRequestEvent:
+		ctrlOnDiagnosticRequest(e)
+	case *controller.QuarantineEvent:
+		ctrlOnQuarantine(e)
+	case *controller.UnknownEvent:
+		log.Warn().Str("type", e.Type).Str("codec", e.Codec).Int("size", len(e.Data)).Msg("Unhandled controller message")
+	case *controller.SecurityEvent:
+		log.Error().
+			Bool("security", true).
+			Str("type", e.Type).
+			Str("endpoint", ctrlEndpoint()).
+			Err(e.Reason).
+			Msg("Rejected controller message")
+	case *controller.ErrorEvent:
+		log.Error().Err(e.Err).Msg("Error parsing controller message")
+	}
+}
+
+func ctrlOnConnectionState(e *controller.ConnectionStateEvent) {
+	switch e.State {
+	case controller.StateConnecting:
+		log.Info().Msg("Connecting to controller")
+	case controller.StateConnected:
+		log.Info().Str("endpoint", ctrlEndpoint()).Msg("Connected to controller")
+
+		// Every new connection starts unauthenticated
+		connection := nextConnection()
+		err := ctrlLogin()
+		if err != nil {
+			retryLogin(connection, err)
+			return
+		}
+
+		loginRetry.Lock()
+		loginRetry.delay = 0
+		loginRetry.Unlock()
+	case controller.StateDisconnected:
+		log.Warn().Err(e.Err).Msg("Disconnected from controller")
+		setAuthenticated(false)
+	}
+}
+
+// loginRetry : delay before dropping a connection whose login failed, doubled on every failure in a row.
+// Kept apart from the transport, whose reconnect backoff starts over on every reset
+var loginRetry = struct {
+	sync.Mutex
+	delay time.Duration
+	// connection : counts connections, so that a retry never drops a newer one
+	connection uint64
+}{}
+
+const (
+	loginMinBackoff = 5 * time.Second
+	loginMaxBackoff = 5 * time.Minute
+)
+
+func nextConnection() uint64 {
+	loginRetry.Lock()
+	defer loginRetry.Unlock()
+
+	loginRetry.connection++
+	return loginRetry.connection
+}
+
+// retryLogin : drops connection after the login backoff so that login is tried again on a new one.
+// Controller may keep answering heartbeats on a connection that never authenticated
+func retryLogin(connection uint64, reason error) {
+	resetter, ok := ctrlTransport.(controller.Resetter)
+	if !ok {
+		log.Error().Err(reason).Msg("Controller login failed")
+		return
+	}
+
+	loginRetry.Lock()
+	loginRetry.delay *= 2
+	if loginRetry.delay < loginMinBackoff {
+		loginRetry.delay = loginMinBackoff
+	}
+	if loginRetry.delay > loginMaxBackoff {
+		loginRetry.delay = loginMaxBackoff
+	}
+	delay := loginRetry.delay
+	loginRetry.Unlock()
+
+	log.Error().Err(reason).Dur("retry", delay).Msg("Controller login failed")
+
+	time.AfterFunc(delay, func() {
+		loginRetry.Lock()
+		current := loginRetry.connection == connection
+		loginRetry.Unlock()
+
+		if current && !isAuthenticated() {
+			resetter.Reset(fmt.Errorf("login failed: %s", reason))
+		}
+	})
+}
+
+func storeCredentials(creds controller.InitResponse) {
+	// Node key is a secret, never logged
+	log.Info().
+		Str("NodeID", creds.NodeID).
+		Msg("Received new node credentials")
+
+	// Set newly acquired node id
+	config.Set("NodeID", creds.NodeID)
+	config.Set("NodeKey", creds.NodeKey)
+	WriteConfig()
+}
+
+// ctrlLogin : performs handshake and authenticates, storing new credentials first if node had none.
+// Pending enrollment token is sent along and spent once the controller answers
+func ctrlLogin() error {
+	nodeID := config.GetString("NodeID")
+	nodeKey := config.GetString("NodeKey")
+	token := config.GetString("EnrollmentToken")
+
+	if nodeKey == "" {
+		nodeID = ""
+	}
+
+	resp, err := ctrl.Init(controller.InitRequest{
+		NodeID:          nodeID,
+		DaemonVersion:   Version,
+		VPNBackends:     vpn.SupportedKinds(),
+		Features:        controller.SupportedFeatures,
+		EnrollmentToken: token,
+	})
+	if err != nil {
+		// Rejected token would be rejected again, only transport failures are retried
+		var remote *controller.RemoteError
+		if token != "" && errors.As(err, &remote) {
+			finishEnrollment(err)
+		}
+		return fmt.Errorf("controller init failed: %s", err)
+	}
+
+	capabilities := ctrl.Capabilities()
+	log.Info().
+		Str("codec", ctrl.Codec()).
+		Int("protocolVersion", capabilities.ProtocolVersion).
+		Strs("features", capabilities.List()).
+		Msg("Controller handshake complete")
+
+	if nodeID == "" && (resp.NodeID == "" || resp.NodeKey == "") {
+		err = fmt.Errorf("controller did not issue node credentials")
+		if token != "" {
+			finishEnrollment(err)
+		}
+		return err
+	}
+
+	// Enrollment may reissue credentials of known nodes
+	if resp.NodeID != "" && resp.NodeKey != "" {
+		storeCredentials(resp)
+		nodeID, nodeKey = resp.NodeID, resp.NodeKey
+	}
+
+	err = ctrl.Authenticate(nodeID, nodeKey)
+	if token != "" {
+		if err == nil && resp.Organization != "" {
+			config.Set("Organization", resp.Organization)
+		}
+		log.Info().Str("organization", resp.Organization).Err(err).Msg("Node enrollment complete")
+		finishEnrollment(err)
+	}
+	if err != nil {
+		return fmt.Errorf("controller authentication failed: %s", err)
+	}
+
+	log.Info().Msg("Controller authentication successful")
+
+	// Results and leave requests from while offline go out before anything else
+	flushOutbox()
+
+	// Controller gets a fresh view of the node on every login
+	setAuthenticated(true)
+	notifyStatusChanged()
+
+	// Networks pre-approved by enrollment are joined like any other, so the controller gets their keys
+	for _, m := range resp.Networks {
+		if m.Status != controller.MembershipApproved {
+			onReplyMembership(m.NetworkID, m.Status)
+			continue
+		}
+
+		state, err := joinNetwork(m.NetworkID)
+		if err != nil {
+			log.Error().Err(err).Str("network", m.NetworkID).Msg("Error joining network granted by enrollment")
+			continue
+		}
+		log.Info().Str("network", m.NetworkID).Str("state", state).Msg("Joined network granted by enrollment")
+	}
+
+	return nil
+}
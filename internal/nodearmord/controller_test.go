@@ -0,0 +1,88 @@
+package nodearmord
+
+import (
+	"crypto/ed25519"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/internal/controller/fakecontroller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+)
+
+const testTimeout = 5 * time.Second
+
+func TestControllerLoopback(t *testing.T) {
+	configDir = t.TempDir()
+	config.Set("NodeID", "")
+	config.Set("NodeKey", "")
+
+	publicKey, signingKey, err := ed25519.GenerateKey(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	node, remote := controller.NewLoopbackPair()
+	fake := fakecontroller.New(remote)
+	fake.SigningKey = signingKey
+	go fake.Run()
+
+	SetController(node)
+	ctrl.SetSigningKeys([]ed25519.PublicKey{publicKey})
+
+	var wg sync.WaitGroup
+	stop := make(signalCh)
+	RunController(&wg, stop)
+	HandleControllerEvents(&wg, stop)
+	defer func() {
+		close(stop)
+		wg.Wait()
+	}()
+
+	err = ctrlLogin()
+	if err != nil {
+		t.Fatalf("login failed: %s", err)
+	}
+
+	// Node without credentials gets them issued on init and proves them without sending the key
+	for _, kind := range []string{"init", "authChallenge", "auth"} {
+		_, err = fake.Expect(kind, testTimeout)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if config.GetString("NodeID") != fake.NodeID || config.GetString("NodeKey") != fake.NodeKey {
+		t.Fatalf("issued credentials not stored")
+	}
+	if !isAuthenticated() {
+		t.Fatalf("node not authenticated after login")
+	}
+
+	err = fake.Push("networkConfig", controller.NetworkConfig{
+		NetworkID: "lab",
+		Kind:      "none",
+		Version:   3,
+		Config:    vpn.NetworkConfig{SelfID: fake.NodeID},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	req, err := fake.Expect("networkConfigResult", testTimeout)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var result controller.NetworkConfigResult
+	err = req.Decode(&result)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.NetworkID != "lab" || result.Version != 3 {
+		t.Fatalf("result for %s version %d, expected lab version 3", result.NetworkID, result.Version)
+	}
+	if result.Success || result.Error == "" {
+		t.Fatalf("configuration of unknown VPN kind reported as applied")
+	}
+}
@@ -0,0 +1,253 @@
+package nodearmord
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"os/exec"
+	"strings"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	diagnosticTimeout = 30 * time.Second
+	pingCount         = "4"
+	pingWait          = "2"
+)
+
+// diagnosticProbe : built-in probe run on controller request, writes its output to w
+type diagnosticProbe func(ctx context.Context, req controller.DiagnosticRequest, w io.Writer) error
+
+// diagnosticProbes : every probe the daemon implements, only those listed in DiagnosticProbes are run
+var diagnosticProbes = map[string]diagnosticProbe{
+	controller.ProbeConfig: probeConfig,
+	controller.ProbeRoutes: probeRoutes,
+	controller.ProbePing:   probePing,
+}
+
+// diagnosticRunning : holds a value while a probe runs, one probe runs at a time
+var diagnosticRunning = make(chan struct{}, 1)
+
+func ctrlOnDiagnosticRequest(e *controller.DiagnosticRequestEvent) {
+	req := e.DiagnosticRequest
+
+	log.Info().
+		Str("requestId", req.RequestID).
+		Str("probe", req.Probe).
+		Str("network", req.NetworkID).
+		Str("target", req.Target).
+		Msg("Received diagnostic request")
+
+	probe, err := allowedProbe(req.Probe)
+	if err != nil {
+		log.Warn().Err(err).Str("requestId", req.RequestID).Msg("Refused diagnostic request")
+		sendDiagnosticResult(controller.DiagnosticResult{
+			RequestID: req.RequestID,
+			Probe:     req.Probe,
+			Error:     err.Error(),
+		})
+		return
+	}
+
+	select {
+	case diagnosticRunning <- struct{}{}:
+	default:
+		sendDiagnosticResult(controller.DiagnosticResult{
+			RequestID: req.RequestID,
+			Probe:     req.Probe,
+			Error:     "another diagnostic probe is running",
+		})
+		return
+	}
+
+	// Probes may take a while, controller events keep being processed meanwhile
+	go func() {
+		defer func() { <-diagnosticRunning }()
+
+		sendDiagnosticResult(runProbe(probe, req))
+	}()
+}
+
+// allowedProbe : returns probe if it is built in and allowed by local configuration
+func allowedProbe(name string) (diagnosticProbe, error) {
+	for _, allowed := range config.GetStringSlice("DiagnosticProbes") {
+		if allowed != name {
+			continue
+		}
+
+		probe, ok := diagnosticProbes[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown diagnostic probe %s", name)
+		}
+		return probe, nil
+	}
+
+	return nil, fmt.Errorf("diagnostic probe %s not allowed on this node", name)
+}
+
+// runProbe : runs probe with a timeout, keeping at most DiagnosticMaxOutput bytes of its output
+func runProbe(probe diagnosticProbe, req controller.DiagnosticRequest) controller.DiagnosticResult {
+	ctx, cancel := context.WithTimeout(context.Background(), diagnosticTimeout)
+	defer cancel()
+
+	output := &limitedBuffer{limit: config.GetInt("DiagnosticMaxOutput")}
+
+	start := time.Now()
+	err := probe(ctx, req, output)
+
+	result := controller.DiagnosticResult{
+		RequestID: req.RequestID,
+		Probe:     req.Probe,
+		Success:   err == nil,
+		// Output may have been cut inside a multi-byte character
+		Output:     strings.ToValidUTF8(output.String(), ""),
+		Truncated:  output.truncated,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	log.Info().
+		Str("requestId", req.RequestID).
+		Str("probe", req.Probe).
+		Bool("success", result.Success).
+		Int("outputSize", len(result.Output)).
+		Bool("truncated", result.Truncated).
+		Int64("durationMs", result.DurationMs).
+		Msg("Diagnostic probe finished")
+
+	return result
+}
+
+func sendDiagnosticResult(result controller.DiagnosticResult) {
+	err := ctrl.SendMessage("diagnosticResult", result)
+	if err != nil {
+		log.Error().Err(err).Str("requestId", result.RequestID).Msg("Error sending diagnostic result")
+	}
+}
+
+// limitedBuffer : keeps the first limit bytes written to it, dropping the rest. Buffer is not embedded
+// so that io.Copy and io.WriteString cannot bypass the limit
+type limitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+func (b *limitedBuffer) Write(p []byte) (int, error) {
+	room := b.limit - b.buf.Len()
+	if len(p) <= room {
+		return b.buf.Write(p)
+	}
+
+	if room > 0 {
+		b.buf.Write(p[:room])
+	}
+	b.truncated = true
+
+	// Commands keep running until done, their output just isn't kept
+	return len(p), nil
+}
+
+func (b *limitedBuffer) String() string {
+	return b.buf.String()
+}
+
+// diagnosticNetwork : returns VPN of a network the controller configured on this node
+func diagnosticNetwork(networkID string) (vpn.VPN, error) {
+	networkConfigs.Lock()
+	msg, ok := networkConfigs.configs[networkID]
+	networkConfigs.Unlock()
+
+	if !ok {
+		return nil, fmt.Errorf("unknown network %q", networkID)
+	}
+
+	manager, err := vpn.GetVPNManager(msg.Kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.GetNetwork(networkID)
+}
+
+// runCommand : runs fixed command without a shell, writing combined output to w
+func runCommand(ctx context.Context, w io.Writer, name string, args ...string) error {
+	cmd := exec.CommandContext(ctx, name, args...)
+	cmd.Stdout = w
+	cmd.Stderr = w
+
+	err := cmd.Run()
+	if err != nil {
+		return fmt.Errorf("%s failed: %s", name, err)
+	}
+
+	return nil
+}
+
+// probeConfig : dumps rendered configuration of the requested network
+func probeConfig(ctx context.Context, req controller.DiagnosticRequest, w io.Writer) error {
+	network, err := diagnosticNetwork(req.NetworkID)
+	if err != nil {
+		return err
+	}
+
+	dump, err := network.DumpConfig()
+	if err != nil {
+		return err
+	}
+
+	_, err = io.WriteString(w, dump)
+	return err
+}
+
+// probeRoutes : shows IPv4 and IPv6 routing tables
+func probeRoutes(ctx context.Context, req controller.DiagnosticRequest, w io.Writer) error {
+	fmt.Fprintln(w, "# IPv4 routes")
+	err := runCommand(ctx, w, "ip", "-4", "route", "show", "table", "all")
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintln(w, "# IPv6 routes")
+	return runCommand(ctx, w, "ip", "-6", "route", "show", "table", "all")
+}
+
+// probePing : pings target over the tunnel interface of the requested network, target has to be
+// an address inside the network
+func probePing(ctx context.Context, req controller.DiagnosticRequest, w io.Writer) error {
+	target := net.ParseIP(req.Target)
+	if target == nil {
+		return fmt.Errorf("invalid ping target %q", req.Target)
+	}
+
+	network, err := diagnosticNetwork(req.NetworkID)
+	if err != nil {
+		return err
+	}
+
+	status, err := network.Status()
+	if err != nil {
+		return err
+	}
+
+	inside := false
+	for _, addr := range status.Addresses {
+		if addr.Contains(target) {
+			inside = true
+			break
+		}
+	}
+	if !inside {
+		return fmt.Errorf("ping target %s is not inside network %s", target, req.NetworkID)
+	}
+
+	return runCommand(ctx, w, "ping", "-c", pingCount, "-W", pingWait, "-I", status.Interface, target.String())
+}
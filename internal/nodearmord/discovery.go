@@ -0,0 +1,73 @@
+package nodearmord
+
+import (
+	"context"
+	"net/http"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/rs/zerolog/log"
+)
+
+const discoveryRetryInterval = 30 * time.Second
+
+// controllerURLs : returns configured controller URLs, discovering them from ControllerDomain when none are set.
+// Retries failed discovery until it succeeds, returns false if stopped meanwhile
+func controllerURLs(stop signalCh) ([]string, bool) {
+	urls := config.GetStringSlice("ControllerURL")
+	domain := config.GetString("ControllerDomain")
+	if len(urls) > 0 {
+		// Settings written by older versions always hold ControllerURL
+		if domain != "" {
+			log.Warn().
+				Strs("urls", urls).
+				Str("domain", domain).
+				Msg("Both ControllerURL and ControllerDomain are set, using ControllerURL. Clear it to discover controllers")
+		}
+		return urls, true
+	}
+
+	if domain == "" {
+		return []string{defaultControllerURL}, true
+	}
+
+	// Well-known document is served by the controller operator, trust the same CA
+	tlsConfig, err := controller.NewTLSConfig(controller.TLSOptions{
+		CAFile: config.GetString("ControllerCAFile"),
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid controller TLS configuration")
+	}
+
+	proxy, err := controller.ProxyFunc(config.GetString("ControllerProxy"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid controller proxy configuration")
+	}
+
+	discovery := controller.Discovery{
+		Domain:   domain,
+		Resolver: controller.NewResolver(config.GetString("ControllerDNSServer")),
+		Client: &http.Client{
+			Transport: &http.Transport{
+				TLSClientConfig: tlsConfig,
+				Proxy:           proxy,
+			},
+		},
+	}
+
+	for {
+		urls, err := discovery.Discover(context.Background())
+		if err == nil {
+			log.Info().Str("domain", domain).Strs("urls", urls).Msg("Discovered controllers")
+			return urls, true
+		}
+
+		log.Error().Err(err).Dur("retry", discoveryRetryInterval).Msg("Controller discovery failed")
+
+		select {
+		case <-time.After(discoveryRetryInterval):
+		case <-stop:
+			return nil, false
+		}
+	}
+}
@@ -0,0 +1,76 @@
+package nodearmord
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+)
+
+const defaultEnrollTimeout = 60 * time.Second
+
+// enrollment : callers waiting for the outcome of the pending enrollment
+var enrollment = struct {
+	sync.Mutex
+	waiters []chan error
+}{}
+
+// enroll : sends token in the next init handshake and waits for the controller to accept it.
+// Token stays pending after a timeout and is used once the controller is reachable
+func enroll(token string, timeout time.Duration) error {
+	if token == "" {
+		return fmt.Errorf("empty enrollment token")
+	}
+	if timeout <= 0 {
+		timeout = defaultEnrollTimeout
+	}
+
+	resetter, ok := ctrlTransport.(controller.Resetter)
+	if !ok {
+		return fmt.Errorf("controller connection cannot be restarted to enroll")
+	}
+
+	config.Set("EnrollmentToken", token)
+	WriteConfig()
+
+	waiter := make(chan error, 1)
+	enrollment.Lock()
+	enrollment.waiters = append(enrollment.waiters, waiter)
+	enrollment.Unlock()
+
+	// Token is only sent during init, start a new handshake
+	resetter.Reset(fmt.Errorf("enrolling node"))
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+
+	select {
+	case err := <-waiter:
+		return err
+	case <-timer.C:
+		enrollment.Lock()
+		for i, w := range enrollment.waiters {
+			if w == waiter {
+				enrollment.waiters = append(enrollment.waiters[:i], enrollment.waiters[i+1:]...)
+				break
+			}
+		}
+		enrollment.Unlock()
+
+		return fmt.Errorf("timed out waiting for enrollment, it completes once the controller is reachable")
+	}
+}
+
+// finishEnrollment : discards spent token and reports outcome to waiting callers
+func finishEnrollment(err error) {
+	config.Set("EnrollmentToken", "")
+	WriteConfig()
+
+	enrollment.Lock()
+	for _, waiter := range enrollment.waiters {
+		waiter <- err
+	}
+	enrollment.waiters = nil
+	enrollment.Unlock()
+}
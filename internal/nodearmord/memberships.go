@@ -0,0 +1,461 @@
+package nodearmord
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"github.com/rs/zerolog/log"
+)
+
+const membershipsFileName = "networks.json"
+
+// Local membership states of a network
+const (
+	MembershipPending  = "pending"
+	MembershipApproved = "approved"
+	MembershipActive   = "active"
+	MembershipRejected = "rejected"
+	MembershipLeft     = "left"
+)
+
+// membership : local state of a network this node joined or tried to join
+type membership struct {
+	NetworkID string    `json:"networkId"`
+	Kind      string    `json:"kind,omitempty"`
+	State     string    `json:"state"`
+	Updated   time.Time `json:"updated"`
+	// Created : backend network was created for a join, removed again if that join never gets configured
+	Created bool `json:"created,omitempty"`
+}
+
+// memberships : membership per network id, persisted so pending joins survive restarts
+var memberships = struct {
+	sync.Mutex
+	networks map[string]membership
+	// waiters : channels notified on every state change of a network
+	waiters map[string][]chan string
+}{
+	networks: make(map[string]membership),
+	waiters:  make(map[string][]chan string),
+}
+
+func membershipsFile() string {
+	return filepath.Join(configDir, membershipsFileName)
+}
+
+// loadMemberships : reads persisted membership states, missing file means no memberships
+func loadMemberships() {
+	buf, err := ioutil.ReadFile(membershipsFile())
+	if os.IsNotExist(err) {
+		return
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading network memberships")
+		return
+	}
+
+	var list []membership
+	err = json.Unmarshal(buf, &list)
+	if err != nil {
+		log.Error().Err(err).Msg("Error parsing network memberships")
+		return
+	}
+
+	memberships.Lock()
+	for _, m := range list {
+		memberships.networks[m.NetworkID] = m
+	}
+	memberships.Unlock()
+}
+
+// saveMemberships : writes membership states, caller holds the lock
+func saveMemberships() {
+	list := make([]membership, 0, len(memberships.networks))
+	for _, m := range memberships.networks {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NetworkID < list[j].NetworkID
+	})
+
+	buf, err := json.MarshalIndent(list, "", "  ")
+	if err != nil {
+		log.Error().Err(err).Msg("Error encoding network memberships")
+		return
+	}
+
+	err = writeFileAtomic(membershipsFile(), buf)
+	if err != nil {
+		log.Error().Err(err).Msg("Error writing network memberships")
+	}
+}
+
+// setMembershipVPN : records VPN backend of network and whether it was created for the join, its state
+// stays as it is
+func setMembershipVPN(networkID string, kind string, created bool) {
+	memberships.Lock()
+	defer memberships.Unlock()
+
+	m, ok := memberships.networks[networkID]
+	if !ok || (m.Kind == kind && m.Created == created) {
+		return
+	}
+
+	m.Kind = kind
+	m.Created = created
+	memberships.networks[networkID] = m
+	saveMemberships()
+}
+
+// setMembership : records new state of network and wakes anyone waiting on it, empty kind keeps known kind
+func setMembership(networkID string, state string, kind string) {
+	memberships.Lock()
+	old := memberships.networks[networkID]
+	if kind == "" {
+		kind = old.Kind
+	}
+	if old.State == state && old.Kind == kind {
+		memberships.Unlock()
+		return
+	}
+
+	memberships.networks[networkID] = membership{
+		NetworkID: networkID,
+		Kind:      kind,
+		State:     state,
+		Updated:   time.Now(),
+		Created:   old.Created,
+	}
+	saveMemberships()
+
+	for _, waiter := range memberships.waiters[networkID] {
+		select {
+		case waiter <- state:
+		default:
+		}
+	}
+	memberships.Unlock()
+
+	log.Info().Str("network", networkID).Str("from", old.State).Str("to", state).Msg("Network membership changed")
+
+	notifyStatusChanged()
+}
+
+// getMembership : returns state of network, empty if node never joined it
+func getMembership(networkID string) string {
+	memberships.Lock()
+	defer memberships.Unlock()
+
+	return memberships.networks[networkID].State
+}
+
+// listMemberships : returns memberships ordered by network id
+func listMemberships() []membership {
+	memberships.Lock()
+	defer memberships.Unlock()
+
+	list := make([]membership, 0, len(memberships.networks))
+	for _, m := range memberships.networks {
+		list = append(list, m)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].NetworkID < list[j].NetworkID
+	})
+
+	return list
+}
+
+// waitMembership : blocks until network leaves pending state or timeout expires, zero timeout waits forever
+func waitMembership(networkID string, timeout time.Duration) (string, error) {
+	waiter := make(chan string, 1)
+
+	memberships.Lock()
+	state := memberships.networks[networkID].State
+	if state != MembershipPending {
+		memberships.Unlock()
+		return state, nil
+	}
+	memberships.waiters[networkID] = append(memberships.waiters[networkID], waiter)
+	memberships.Unlock()
+
+	defer func() {
+		memberships.Lock()
+		waiters := memberships.waiters[networkID]
+		for i, w := range waiters {
+			if w == waiter {
+				memberships.waiters[networkID] = append(waiters[:i], waiters[i+1:]...)
+				break
+			}
+		}
+		if len(memberships.waiters[networkID]) == 0 {
+			delete(memberships.waiters, networkID)
+		}
+		memberships.Unlock()
+	}()
+
+	var expired <-chan time.Time
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		expired = timer.C
+	}
+
+	for {
+		select {
+		case state = <-waiter:
+			if state != MembershipPending {
+				return state, nil
+			}
+		case <-expired:
+			return MembershipPending, fmt.Errorf("timed out waiting for approval of network %s", networkID)
+		}
+	}
+}
+
+// joinNetwork : asks controller for membership of network, returning resulting local state
+func joinNetwork(networkID string) (string, error) {
+	err := vpn.CheckNetworkID(networkID)
+	if err != nil {
+		return "", err
+	}
+	if !isAuthenticated() {
+		return "", fmt.Errorf("not connected to controller")
+	}
+	if isQuarantined() {
+		return "", fmt.Errorf("node is quarantined")
+	}
+
+	kind, network, created, err := joinVPN(networkID)
+	if err != nil {
+		return "", fmt.Errorf("error joining network %s: %s", networkID, err)
+	}
+
+	status, err := requestJoin(networkID, network)
+	if err == nil {
+		onReplyMembership(networkID, status)
+	}
+
+	// Network created for this join is only kept while the controller may still approve it
+	state := getMembership(networkID)
+	if err != nil || state == "" || state == MembershipRejected {
+		if created {
+			removeJoinVPN(networkID, kind)
+			setMembershipVPN(networkID, kind, false)
+		}
+	} else {
+		setMembershipVPN(networkID, kind, created)
+	}
+	if err != nil {
+		return "", fmt.Errorf("error joining network %s: %s", networkID, err)
+	}
+
+	return state, nil
+}
+
+// joinVPN : returns network of backend VPNKind to join, created before asking the controller so that its key
+// exists. created is set if it did not exist before or an earlier join created it
+func joinVPN(networkID string) (kind string, network vpn.VPN, created bool, err error) {
+	memberships.Lock()
+	kind = memberships.networks[networkID].Kind
+	created = memberships.networks[networkID].Created
+	memberships.Unlock()
+
+	if kind == "" {
+		kind = config.GetString("VPNKind")
+	}
+
+	manager, err := vpn.GetVPNManager(kind)
+	if err != nil {
+		return kind, nil, false, err
+	}
+
+	network, err = manager.GetNetwork(networkID)
+	if err == nil {
+		return kind, network, created, nil
+	}
+
+	network, err = manager.CreateNetwork(networkID)
+	if err != nil {
+		return kind, nil, false, err
+	}
+
+	return kind, network, true, nil
+}
+
+// requestJoin : sends join request carrying public key of network, returning controller verdict
+func requestJoin(networkID string, network vpn.VPN) (string, error) {
+	pubKey, err := network.GetPubKey()
+	if err != nil {
+		return "", err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), controller.DefaultCallTimeout)
+	defer cancel()
+
+	var resp controller.JoinNetworkResponse
+	err = ctrl.Call(ctx, "joinNetwork", controller.JoinNetworkRequest{
+		NetworkID: networkID,
+		PubKey:    pubKey,
+	}, &resp)
+	if err != nil {
+		return "", err
+	}
+
+	return resp.Status, nil
+}
+
+// removeJoinVPN : deletes network created for a join, unless it is already gone
+func removeJoinVPN(networkID string, kind string) {
+	manager, err := vpn.GetVPNManager(kind)
+	if err == nil {
+		_, err = manager.GetNetwork(networkID)
+		if err != nil {
+			return
+		}
+		err = manager.DeleteNetwork(networkID)
+	}
+	if err != nil {
+		log.Error().Err(err).Str("network", networkID).Msg("Error removing network")
+	}
+}
+
+// removeRejectedVPN : deletes network created for a join the controller rejected before configuring it
+func removeRejectedVPN(networkID string) {
+	networkConfigs.Lock()
+	_, configured := networkConfigs.configs[networkID]
+	networkConfigs.Unlock()
+
+	memberships.Lock()
+	m := memberships.networks[networkID]
+	memberships.Unlock()
+
+	if configured || !m.Created || m.Kind == "" {
+		return
+	}
+
+	removeJoinVPN(networkID, m.Kind)
+	setMembershipVPN(networkID, m.Kind, false)
+}
+
+// leaveNetwork : gives up membership of network and removes it locally. While offline the leave request
+// waits in the outbox and the network is removed right away
+func leaveNetwork(networkID string) error {
+	err := vpn.CheckNetworkID(networkID)
+	if err != nil {
+		return err
+	}
+
+	if !isAuthenticated() {
+		err = ctrl.SendMessage("leaveNetwork", controller.LeaveNetworkRequest{NetworkID: networkID})
+		if err != nil {
+			return fmt.Errorf("error leaving network %s: %s", networkID, err)
+		}
+
+		err = removeNetwork(networkID)
+		setMembership(networkID, MembershipLeft, "")
+
+		return err
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), controller.DefaultCallTimeout)
+	defer cancel()
+
+	err = ctrl.Call(ctx, "leaveNetwork", controller.LeaveNetworkRequest{NetworkID: networkID}, nil)
+	if err != nil {
+		return fmt.Errorf("error leaving network %s: %s", networkID, err)
+	}
+
+	err = removeNetwork(networkID)
+	setMembership(networkID, MembershipLeft, "")
+
+	return err
+}
+
+func ctrlOnNetworkMembership(e *controller.NetworkMembershipEvent) {
+	log.Info().Str("network", e.NetworkID).Str("status", e.Status).Msg("Received network membership")
+
+	onMembership(e.NetworkID, e.Status)
+}
+
+// onReplyMembership : applies membership status taken from an unsigned reply. Replies may only move a
+// network to approved, pending or rejected, removals are only accepted from signed membership pushes
+func onReplyMembership(networkID string, status string) {
+	switch status {
+	case controller.MembershipPending, controller.MembershipApproved, controller.MembershipRejected:
+		onMembership(networkID, status)
+	default:
+		log.Warn().Str("network", networkID).Str("status", status).Msg("Ignored network membership status of controller reply")
+	}
+}
+
+// onMembership : moves network to local state matching controller verdict
+func onMembership(networkID string, status string) {
+	switch status {
+	case controller.MembershipPending:
+		setMembership(networkID, MembershipPending, "")
+	case controller.MembershipApproved:
+		// Configuration may already have arrived and activated the network
+		if getMembership(networkID) == MembershipActive {
+			return
+		}
+		setMembership(networkID, MembershipApproved, "")
+
+		networkConfigs.Lock()
+		_, ok := networkConfigs.configs[networkID]
+		networkConfigs.Unlock()
+
+		// Provision approved network without waiting for the controller to push it
+		if !ok {
+			requestResync(networkID, 0, fmt.Errorf("membership approved"))
+		}
+	case controller.MembershipRejected:
+		setMembership(networkID, MembershipRejected, "")
+		removeRejectedVPN(networkID)
+	case controller.MembershipRemoved:
+		err := removeNetwork(networkID)
+		if err != nil {
+			log.Error().Err(err).Str("network", networkID).Msg("Error removing network")
+		}
+		setMembership(networkID, MembershipLeft, "")
+	default:
+		log.Warn().Str("network", networkID).Str("status", status).Msg("Unknown network membership status")
+	}
+}
+
+// removeNetwork : forgets configuration of network and deletes it from its VPN backend
+func removeNetwork(networkID string) error {
+	networkConfigs.Lock()
+	delete(networkConfigs.configs, networkID)
+	networkConfigs.Unlock()
+
+	memberships.Lock()
+	kind := memberships.networks[networkID].Kind
+	memberships.Unlock()
+
+	// Never provisioned, nothing to tear down
+	if kind == "" {
+		return nil
+	}
+
+	// Quarantine keeps every network in place, release deletes the ones left meanwhile
+	if isQuarantined() {
+		log.Warn().Str("network", networkID).Msg("Node is quarantined, network is deleted once released")
+		return nil
+	}
+
+	manager, err := vpn.GetVPNManager(kind)
+	if err != nil {
+		return err
+	}
+
+	return manager.DeleteNetwork(networkID)
+}
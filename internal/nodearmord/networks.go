@@ -0,0 +1,204 @@
+package nodearmord
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"github.com/rs/zerolog/log"
+)
+
+// networkConfigs : last configuration received per network, base for deltas
+var networkConfigs = struct {
+	sync.Mutex
+	configs map[string]controller.NetworkConfig
+}{
+	configs: make(map[string]controller.NetworkConfig),
+}
+
+func ctrlOnNetworkConfig(e *controller.NetworkConfigEvent) {
+	log.Info().
+		Str("network", e.NetworkID).
+		Str("kind", e.Kind).
+		Uint64("version", e.Version).
+		Int("nodes", len(e.Config.Nodes)).
+		Msg("Received network configuration")
+
+	updateNetworkConfig(e.NetworkConfig)
+}
+
+func ctrlOnNetworkConfigDelta(e *controller.NetworkConfigDeltaEvent) {
+	log.Info().
+		Str("network", e.NetworkID).
+		Uint64("baseVersion", e.BaseVersion).
+		Uint64("version", e.Version).
+		Msg("Received network configuration delta")
+
+	networkConfigs.Lock()
+	base, ok := networkConfigs.configs[e.NetworkID]
+	networkConfigs.Unlock()
+
+	if !ok {
+		requestResync(e.NetworkID, 0, fmt.Errorf("no configuration to apply delta to"))
+		return
+	}
+
+	msg, err := e.Apply(base)
+	if err != nil {
+		requestResync(e.NetworkID, base.Version, err)
+		return
+	}
+
+	updateNetworkConfig(msg)
+}
+
+// requestResync : asks controller for full configuration after delta could not be applied
+func requestResync(networkID string, version uint64, reason error) {
+	log.Warn().Err(reason).Str("network", networkID).Msg("Requesting full network configuration")
+
+	err := ctrl.SendMessage("networkConfigResync", controller.NetworkConfigResync{
+		NetworkID: networkID,
+		Version:   version,
+	})
+	if err != nil {
+		log.Error().Err(err).Str("network", networkID).Msg("Error requesting network configuration")
+	}
+}
+
+// updateNetworkConfig : remembers configuration, applies it and reports result to the controller.
+// Quarantined nodes refuse every configuration
+func updateNetworkConfig(msg controller.NetworkConfig) {
+	if isQuarantined() {
+		log.Warn().Str("network", msg.NetworkID).Uint64("version", msg.Version).Msg("Refused network configuration, node is quarantined")
+
+		err := ctrl.SendMessage("networkConfigResult", controller.NetworkConfigResult{
+			NetworkID: msg.NetworkID,
+			Version:   msg.Version,
+			Error:     "node is quarantined",
+		})
+		if err != nil {
+			log.Error().Err(err).Str("network", msg.NetworkID).Msg("Error reporting network configuration result")
+		}
+		return
+	}
+
+	// Signed configuration addressed to another node must not be applied here
+	nodeID := config.GetString("NodeID")
+	if msg.Config.SelfID != nodeID {
+		log.Error().
+			Bool("security", true).
+			Str("network", msg.NetworkID).
+			Str("selfId", msg.Config.SelfID).
+			Str("endpoint", ctrlEndpoint()).
+			Msg("Rejected network configuration for another node")
+
+		err := ctrl.SendMessage("networkConfigResult", controller.NetworkConfigResult{
+			NetworkID: msg.NetworkID,
+			Version:   msg.Version,
+			Error:     fmt.Sprintf("configuration is for node %s, not %s", msg.Config.SelfID, nodeID),
+		})
+		if err != nil {
+			log.Error().Err(err).Str("network", msg.NetworkID).Msg("Error reporting network configuration result")
+		}
+		return
+	}
+
+	// Controller bases further deltas on this version whether or not it applies
+	networkConfigs.Lock()
+	networkConfigs.configs[msg.NetworkID] = msg
+	networkConfigs.Unlock()
+
+	start := time.Now()
+	hash, err := applyNetworkConfig(msg)
+
+	result := controller.NetworkConfigResult{
+		NetworkID:  msg.NetworkID,
+		Version:    msg.Version,
+		Success:    err == nil,
+		ConfigHash: hash,
+		DurationMs: time.Since(start).Milliseconds(),
+	}
+
+	if err != nil {
+		log.Error().Err(err).Str("network", msg.NetworkID).Msg("Error applying network configuration")
+
+		result.Error = err.Error()
+	} else {
+		log.Info().
+			Str("network", msg.NetworkID).
+			Uint64("version", msg.Version).
+			Str("hash", hash).
+			Int64("durationMs", result.DurationMs).
+			Msg("Network configuration applied")
+	}
+
+	err = ctrl.SendMessage("networkConfigResult", result)
+	if err != nil {
+		log.Error().Err(err).Str("network", msg.NetworkID).Msg("Error reporting network configuration result")
+	}
+
+	if hash != "" {
+		// Network exists locally once rendered, even if it failed to start
+		setMembership(msg.NetworkID, MembershipActive, msg.Kind)
+	}
+
+	notifyStatusChanged()
+}
+
+// applyNetworkConfig : writes network configuration, starting new networks and reloading running ones.
+// Returns hash of the rendered configuration, empty if it could not be written
+func applyNetworkConfig(msg controller.NetworkConfig) (string, error) {
+	if msg.NetworkID == "" {
+		return "", fmt.Errorf("network configuration without network id")
+	}
+
+	err := vpn.CheckNetworkID(msg.NetworkID)
+	if err != nil {
+		return "", err
+	}
+
+	manager, err := vpn.GetVPNManager(msg.Kind)
+	if err != nil {
+		return "", err
+	}
+
+	created := false
+	network, err := manager.GetNetwork(msg.NetworkID)
+	if err != nil {
+		network, err = manager.CreateNetwork(msg.NetworkID)
+		if err != nil {
+			return "", err
+		}
+		created = true
+
+		// Configuration may arrive before the join handing in the key, which then reports this one
+		_, err = network.GetPubKey()
+		if err != nil {
+			return "", fmt.Errorf("error generating keys of network %s: %s", msg.NetworkID, err)
+		}
+	}
+
+	err = network.SetConfig(msg.Config)
+	if err != nil {
+		return "", fmt.Errorf("error setting configuration of network %s: %s", msg.NetworkID, err)
+	}
+
+	hash, err := network.ConfigHash()
+	if err != nil {
+		return "", fmt.Errorf("error hashing configuration of network %s: %s", msg.NetworkID, err)
+	}
+
+	if created {
+		return hash, network.Start()
+	}
+
+	// Network may exist without running, e.g. after a failed start
+	err = network.Reload()
+	if err != nil {
+		return hash, network.Start()
+	}
+
+	return hash, nil
+}
@@ -1,6 +1,9 @@
 package nodearmord
 
 import (
+	"crypto/ed25519"
+	"flag"
+	"io"
 	"os"
 	"os/signal"
 	"sync"
@@ -13,15 +16,50 @@ import (
 
 type signalCh chan os.Signal
 
-var ctrlTransport controller.WebsocketTransport
-var ctrl = controller.NewJsonAPI(&ctrlTransport)
+// wsTransport : websocket connection to the controller, used unless SetController replaces it
+var wsTransport controller.WebsocketTransport
+
+// ctrlTransport, ctrl : controller connection and the API spoken over it
+var ctrlTransport controller.Transport = &wsTransport
+var ctrl = controller.NewJsonAPI(ctrlTransport)
+
+// SetController : replaces websocket controller connection with t, e.g. one end of a loopback pair to a fake
+// controller. Has to be called before Run. Transports without state notifications count as connected
+func SetController(t controller.Transport) {
+	ctrlTransport = t
+	ctrl = controller.NewJsonAPI(t)
+}
+
+// usesWebsocket : whether controller connection is the default websocket one
+func usesWebsocket() bool {
+	return ctrlTransport == controller.Transport(&wsTransport)
+}
+
+// ctrlEndpoint : returns URL of connected controller, empty if transport has none
+func ctrlEndpoint() string {
+	if endpoint, ok := ctrlTransport.(interface{ Endpoint() string }); ok {
+		return endpoint.Endpoint()
+	}
+
+	return ""
+}
+
+// closeController : ends controller connection, making Run of the controller API return
+func closeController() {
+	switch t := ctrlTransport.(type) {
+	case interface{ Disconnect() error }:
+		t.Disconnect()
+	case io.Closer:
+		t.Close()
+	}
+}
 
 func RunController(wg *sync.WaitGroup, stop chan os.Signal) {
 	wg.Add(1)
 
 	go func() {
 		<-stop
-		ctrlTransport.Disconnect()
+		closeController()
 	}()
 
 	go func() {
@@ -30,11 +68,24 @@ func RunController(wg *sync.WaitGroup, stop chan os.Signal) {
 	}()
 }
 
+// Run : parses command line and runs daemon until SIGTERM or SIGINT. Instances sharing a host need their
+// own -config-dir and -rpc, which also separates their tinc networks
 func Run() {
-	// Bind os signals to stop channel
+	configDirFlag := flag.String("config-dir", "", "directory of settings.json, local state and own tinc networks, default ~/.nodearmor")
+	rpcAddr := flag.String("rpc", "", "address to serve RPC on, overrides RPCAddress setting")
+	flag.Parse()
+
+	configDir = *configDirFlag
+
+	// Bind os signals to stop channel, closing it notifies every goroutine
+	var sig = make(signalCh, 1)
 	var stop = make(signalCh)
-	signal.Notify(stop, syscall.SIGTERM)
-	signal.Notify(stop, syscall.SIGINT)
+	signal.Notify(sig, syscall.SIGTERM)
+	signal.Notify(sig, syscall.SIGINT)
+	go func() {
+		<-sig
+		close(stop)
+	}()
 
 	// goroutine waitgroup
 	var wg sync.WaitGroup
@@ -43,19 +94,84 @@ func Run() {
 	log.Logger = log.Output(zerolog.ConsoleWriter{Out: os.Stdout})
 
 	LoadConfig()
+	if *configDirFlag != "" {
+		separateVPNInstance()
+	}
+	if *rpcAddr != "" {
+		config.Set("RPCAddress", *rpcAddr)
+	}
+	loadMemberships()
+	loadQuarantine()
+
+	wsTransport.PingInterval = config.GetDuration("PingInterval")
+	wsTransport.PongTimeout = config.GetDuration("PongTimeout")
+	wsTransport.FailbackInterval = config.GetDuration("ControllerFailbackInterval")
+	ctrl.SetHeartbeatInterval(config.GetDuration("HeartbeatInterval"))
+	ctrl.SetLegacyKeyAuth(config.GetBool("AllowLegacyKeyAuth"))
+
+	tlsConfig, err := controller.NewTLSConfig(controller.TLSOptions{
+		CAFile:     config.GetString("ControllerCAFile"),
+		PinnedKeys: config.GetStringSlice("ControllerPinnedKeys"),
+		CertFile:   config.GetString("ControllerCertFile"),
+		KeyFile:    config.GetString("ControllerKeyFile"),
+	})
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid controller TLS configuration")
+	}
+	wsTransport.TLSConfig = tlsConfig
+
+	var signingKeys []ed25519.PublicKey
+	for _, s := range config.GetStringSlice("ControllerSigningKeys") {
+		key, err := controller.ParseSigningKey(s)
+		if err != nil {
+			log.Fatal().Err(err).Msg("Invalid controller signing key")
+		}
+		signingKeys = append(signingKeys, key)
+	}
+	allowUnsigned := config.GetBool("AllowUnsignedController")
+	if len(signingKeys) == 0 && allowUnsigned {
+		log.Warn().Msg("No controller signing key pinned, configuration messages are accepted unsigned")
+	} else if len(signingKeys) == 0 {
+		log.Error().Msg("No controller signing key pinned, configuration messages are rejected until ControllerSigningKeys is set")
+	}
+	ctrl.SetSigningKeys(signingKeys)
+	ctrl.SetAllowUnsigned(allowUnsigned)
+	ctrl.SetReplayStore(loadReplayStore())
+	ctrl.SetMaxClockSkew(config.GetDuration("ControllerMaxClockSkew"))
 
-	err := ctrlTransport.Connect(config.GetString("ControllerURL"))
+	err = ctrl.SetOutbox(fileOutboxStore{}, config.GetInt("OutboxLimit"), config.GetDuration("OutboxTTL"))
 	if err != nil {
-		log.Fatal().Err(err).Msg("Controller connection failed")
+		log.Error().Err(err).Msg("Error loading messages queued for controller")
+	}
+
+	wsTransport.Proxy, err = controller.ProxyFunc(config.GetString("ControllerProxy"))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Invalid controller proxy configuration")
+	}
+
+	if usesWebsocket() {
+		urls, ok := controllerURLs(stop)
+		if !ok {
+			return
+		}
+
+		// Failed connection is retried in background once controller processing starts
+		err = wsTransport.Connect(urls...)
+		if err != nil {
+			log.Error().Err(err).Msg("Controller connection failed")
+		}
 	}
 
 	// Begin processing controller
 	RunController(&wg, stop)
+	HandleControllerEvents(&wg, stop)
+	if _, ok := ctrlTransport.(controller.StateNotifier); !ok {
+		go ctrlOnEvent(&controller.ConnectionStateEvent{State: controller.StateConnected})
+	}
+	StartStatusReporter(&wg, stop)
 	// Start RPC server
 	StartRPCServer(&wg, stop)
 
-	ctrl.Init()
-
 	// Wait for all goroutines
 	wg.Wait()
 }
@@ -0,0 +1,73 @@
+package nodearmord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/rs/zerolog/log"
+)
+
+const outboxFileName = "outbox.json"
+
+// fileOutboxStore : keeps messages queued for the controller across restarts
+type fileOutboxStore struct{}
+
+func outboxFile() string {
+	return filepath.Join(configDir, outboxFileName)
+}
+
+// LoadOutbox : reads queued messages, missing file means none are queued
+func (fileOutboxStore) LoadOutbox() ([]controller.OutboxEntry, error) {
+	buf, err := ioutil.ReadFile(outboxFile())
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error reading outbox: %s", err)
+	}
+
+	var entries []controller.OutboxEntry
+	err = json.Unmarshal(buf, &entries)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing outbox: %s", err)
+	}
+
+	return entries, nil
+}
+
+// SaveOutbox : writes queued messages in sending order
+func (fileOutboxStore) SaveOutbox(entries []controller.OutboxEntry) error {
+	if entries == nil {
+		entries = []controller.OutboxEntry{}
+	}
+
+	buf, err := json.MarshalIndent(entries, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding outbox: %s", err)
+	}
+
+	err = writeFileAtomic(outboxFile(), buf)
+	if err != nil {
+		return fmt.Errorf("error writing outbox: %s", err)
+	}
+
+	return nil
+}
+
+// flushOutbox : sends messages queued while the node was offline, once it is authenticated again
+func flushOutbox() {
+	sent, expired, err := ctrl.FlushOutbox()
+	if expired > 0 {
+		log.Warn().Int("count", expired).Msg("Dropped expired messages queued for controller")
+	}
+	if sent > 0 {
+		log.Info().Int("count", sent).Msg("Sent messages queued while offline")
+	}
+	if err != nil {
+		log.Error().Err(err).Int("queued", ctrl.OutboxLength()).Msg("Error sending queued controller messages")
+	}
+}
@@ -0,0 +1,253 @@
+package nodearmord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"github.com/rs/zerolog/log"
+)
+
+const quarantineFileName = "quarantine.json"
+
+// quarantineState : why and since when node is quarantined, file exists only while it is
+type quarantineState struct {
+	Reason string    `json:"reason"`
+	Since  time.Time `json:"since"`
+}
+
+// quarantine : while active every network stays stopped and configurations are refused
+var quarantine = struct {
+	sync.Mutex
+	active bool
+	state  quarantineState
+}{}
+
+func quarantineFile() string {
+	return filepath.Join(configDir, quarantineFileName)
+}
+
+// loadQuarantine : restores quarantine from before a restart, making sure networks are still stopped
+func loadQuarantine() {
+	buf, err := ioutil.ReadFile(quarantineFile())
+	if os.IsNotExist(err) {
+		return
+	}
+
+	var state quarantineState
+	if err == nil {
+		err = json.Unmarshal(buf, &state)
+	}
+	if err != nil {
+		// Stay cut off rather than bring networks up on a damaged file
+		log.Error().Err(err).Msg("Error reading quarantine state")
+		state.Reason = "unreadable quarantine state"
+	}
+
+	quarantine.Lock()
+	quarantine.active = true
+	quarantine.state = state
+	quarantine.Unlock()
+
+	log.Warn().
+		Str("reason", state.Reason).
+		Time("since", state.Since).
+		Msg("Node is quarantined, networks stay stopped until the controller releases it")
+
+	stopNetworks()
+}
+
+// quarantineStatus : returns whether node is quarantined and why
+func quarantineStatus() (bool, quarantineState) {
+	quarantine.Lock()
+	defer quarantine.Unlock()
+
+	return quarantine.active, quarantine.state
+}
+
+func isQuarantined() bool {
+	active, _ := quarantineStatus()
+	return active
+}
+
+func ctrlOnQuarantine(e *controller.QuarantineEvent) {
+	if e.Release {
+		releaseQuarantine()
+		return
+	}
+
+	enterQuarantine(e.Reason)
+}
+
+// enterQuarantine : persists quarantine before stopping every network, so a crash cannot bring them back up
+func enterQuarantine(reason string) {
+	quarantine.Lock()
+	if !quarantine.active {
+		quarantine.state.Since = time.Now()
+	}
+	quarantine.active = true
+	quarantine.state.Reason = reason
+	state := quarantine.state
+
+	buf, err := json.MarshalIndent(state, "", "  ")
+	if err == nil {
+		err = writeFileAtomic(quarantineFile(), buf)
+	}
+	quarantine.Unlock()
+
+	if err != nil {
+		log.Error().Err(err).Msg("Error writing quarantine state, quarantine ends on restart")
+	}
+
+	log.Warn().Str("reason", reason).Msg("Controller quarantined node, stopping every network")
+
+	stopNetworks()
+	notifyStatusChanged()
+}
+
+// releaseQuarantine : starts networks again and asks controller for their current configuration
+func releaseQuarantine() {
+	quarantine.Lock()
+	if !quarantine.active {
+		quarantine.Unlock()
+		return
+	}
+	quarantine.active = false
+	quarantine.state = quarantineState{}
+
+	err := os.Remove(quarantineFile())
+	quarantine.Unlock()
+
+	if err != nil && !os.IsNotExist(err) {
+		log.Error().Err(err).Msg("Error removing quarantine state")
+	}
+
+	log.Info().Msg("Controller released node from quarantine")
+
+	removeLeftNetworks()
+
+	for networkID, kind := range localNetworks() {
+		network, err := localNetwork(networkID, kind)
+		if err == nil {
+			err = network.Start()
+		}
+		if err != nil {
+			log.Error().Err(err).Str("network", networkID).Msg("Error starting network")
+		}
+
+		// Configurations refused during quarantine may have changed the network
+		networkConfigs.Lock()
+		version := networkConfigs.configs[networkID].Version
+		networkConfigs.Unlock()
+
+		requestResync(networkID, version, fmt.Errorf("quarantine released"))
+	}
+
+	notifyStatusChanged()
+}
+
+// stopNetworks : stops every network of the VPN backends, including ones local state does not know of.
+// Their configuration stays in place
+func stopNetworks() {
+	networks := localNetworks()
+	for _, kind := range vpn.SupportedKinds() {
+		manager, err := vpn.GetVPNManager(kind)
+		if err != nil {
+			continue
+		}
+
+		ids, err := manager.ListNetworks()
+		if err != nil {
+			log.Error().Err(err).Str("kind", kind).Msg("Error listing networks")
+			continue
+		}
+
+		for _, id := range ids {
+			if _, ok := networks[id]; !ok {
+				networks[id] = kind
+			}
+		}
+	}
+
+	for networkID, kind := range networks {
+		network, err := localNetwork(networkID, kind)
+		if err == nil {
+			err = network.Stop()
+		}
+		if err != nil {
+			log.Error().Err(err).Str("network", networkID).Msg("Error stopping network")
+			continue
+		}
+
+		log.Info().Str("network", networkID).Msg("Network stopped")
+	}
+}
+
+// removeLeftNetworks : deletes networks whose removal was deferred by quarantine
+func removeLeftNetworks() {
+	memberships.Lock()
+	left := make(map[string]string)
+	for id, m := range memberships.networks {
+		if m.Kind != "" && m.State == MembershipLeft {
+			left[id] = m.Kind
+		}
+	}
+	memberships.Unlock()
+
+	for networkID, kind := range left {
+		manager, err := vpn.GetVPNManager(kind)
+		if err != nil {
+			continue
+		}
+
+		// Networks left outside quarantine are already gone
+		if _, err := manager.GetNetwork(networkID); err != nil {
+			continue
+		}
+
+		err = manager.DeleteNetwork(networkID)
+		if err != nil {
+			log.Error().Err(err).Str("network", networkID).Msg("Error removing network")
+			continue
+		}
+
+		log.Info().Str("network", networkID).Msg("Removed network left during quarantine")
+	}
+}
+
+// localNetworks : returns kind by id of every network configured on this node that it did not leave.
+// Networks only created for a pending join have no configuration to run
+func localNetworks() map[string]string {
+	networks := make(map[string]string)
+
+	memberships.Lock()
+	for id, m := range memberships.networks {
+		if m.Kind != "" && m.State == MembershipActive {
+			networks[id] = m.Kind
+		}
+	}
+	memberships.Unlock()
+
+	networkConfigs.Lock()
+	for id, msg := range networkConfigs.configs {
+		networks[id] = msg.Kind
+	}
+	networkConfigs.Unlock()
+
+	return networks
+}
+
+func localNetwork(networkID string, kind string) (vpn.VPN, error) {
+	manager, err := vpn.GetVPNManager(kind)
+	if err != nil {
+		return nil, err
+	}
+
+	return manager.GetNetwork(networkID)
+}
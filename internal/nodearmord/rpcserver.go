@@ -6,6 +6,7 @@ import (
 	"net/http"
 	"net/rpc"
 	"sync"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -17,48 +18,115 @@ const (
 
 type NetworkRPC struct{}
 
-func (t *NetworkRPC) Join(id string, reply *bool) error {
-	log.Printf("RPC: Joining network %s", id)
+// WaitArgs : network to wait for and how long, zero timeout waits until controller decides
+type WaitArgs struct {
+	NetworkID string
+	Timeout   time.Duration
+}
+
+// Join : requests membership of network, replying with resulting local state
+func (t *NetworkRPC) Join(id string, reply *string) error {
+	log.Info().Str("network", id).Msg("RPC: Joining network")
 
-	/*joinNetworkRequest := JoinNetworkRequest{
-		NetworkId: id,
+	state, err := joinNetwork(id)
+	if err != nil {
+		return err
 	}
-	SendMessage("joinNetwork", joinNetworkRequest)*/
 
-	*reply = true
+	*reply = state
 	return nil
 }
 
-/*func (t *NetworkRPC) Leave(id string, reply *string) error {
-	log.Printf("RPC: Leaving network %s", id)
+// Wait : blocks until join of network is approved or rejected, replying with final local state
+func (t *NetworkRPC) Wait(args WaitArgs, reply *string) error {
+	state, err := waitMembership(args.NetworkID, args.Timeout)
+	if err != nil {
+		return err
+	}
 
-	leaveNetworkRequest := LeaveNetworkRequest{
-		NetworkId: id,
+	*reply = state
+	return nil
+}
+
+// Leave : gives up membership of network
+func (t *NetworkRPC) Leave(id string, reply *string) error {
+	log.Info().Str("network", id).Msg("RPC: Leaving network")
+
+	err := leaveNetwork(id)
+	if err != nil {
+		return err
 	}
-	SendMessage("leaveNetwork", leaveNetworkRequest)
 
-	*reply = "ok"
+	*reply = MembershipLeft
 	return nil
 }
 
+// List : replies with state of every network this node joined
 func (t *NetworkRPC) List(tmp bool, reply *string) error {
-	log.Printf("RPC: List networks")
-
-	for _, network := range config.Networks {
-		*reply += fmt.Sprintf("Network %s\n", network.Id)
-		*reply += fmt.Sprintf("  Name: %s\n", network.Name)
-		*reply += fmt.Sprintf("  Subnet: %s\n", network.Subnet)
-		*reply += fmt.Sprintf("  Nodes:\n")
-		for _, node := range network.Nodes {
-			*reply += fmt.Sprintf("    Node %s\n", node.Id)
-			*reply += fmt.Sprintf("      Name: %s\n", node.Name)
-			*reply += fmt.Sprintf("    	 PrivateIP: %s\n", node.PrivateIP)
-			*reply += fmt.Sprintf("    	 PublicIP: %s\n", node.PublicIP)
+	for _, m := range listMemberships() {
+		*reply += fmt.Sprintf("Network %s\n", m.NetworkID)
+		*reply += fmt.Sprintf("  State: %s\n", m.State)
+		if m.Kind != "" {
+			*reply += fmt.Sprintf("  Kind: %s\n", m.Kind)
 		}
+		*reply += fmt.Sprintf("  Updated: %s\n", m.Updated.Format(time.RFC3339))
 	}
 
 	return nil
-}*/
+}
+
+type DaemonRPC struct{}
+
+// EnrollArgs : one-time enrollment token and how long to wait for the controller, zero for default
+type EnrollArgs struct {
+	Token   string
+	Timeout time.Duration
+}
+
+// Enroll : binds node to the organisation of token, replying with the organisation name
+func (t *DaemonRPC) Enroll(args EnrollArgs, reply *string) error {
+	log.Info().Msg("RPC: Enrolling node")
+
+	err := enroll(args.Token, args.Timeout)
+	if err != nil {
+		return err
+	}
+
+	*reply = config.GetString("Organization")
+	return nil
+}
+
+// Status : replies with daemon version, uptime, quarantine, controller connection and latency and networks
+func (t *DaemonRPC) Status(tmp bool, reply *string) error {
+	controllerState := "disconnected"
+	endpoint := ctrlEndpoint()
+	if isAuthenticated() {
+		controllerState = "authenticated"
+	} else if endpoint != "" {
+		controllerState = "connected"
+	}
+
+	*reply += fmt.Sprintf("Version: %s\n", Version)
+	*reply += fmt.Sprintf("Uptime: %s\n", time.Since(startTime).Truncate(time.Second))
+	if organization := config.GetString("Organization"); organization != "" {
+		*reply += fmt.Sprintf("Organization: %s\n", organization)
+	}
+	if quarantined, state := quarantineStatus(); quarantined {
+		*reply += fmt.Sprintf("Quarantine: since %s, %s\n", state.Since.Format(time.RFC3339), state.Reason)
+	}
+	*reply += fmt.Sprintf("Controller: %s\n", controllerState)
+	if endpoint != "" {
+		*reply += fmt.Sprintf("Endpoint: %s\n", endpoint)
+	}
+	if rtt := ctrl.LastRTT(); rtt > 0 {
+		*reply += fmt.Sprintf("Latency: %s\n", rtt.Round(time.Millisecond))
+	}
+	for _, m := range listMemberships() {
+		*reply += fmt.Sprintf("Network %s: %s\n", m.NetworkID, m.State)
+	}
+
+	return nil
+}
 
 func StartRPCServer(wg *sync.WaitGroup, stop signalCh) {
 	networkRPC := new(NetworkRPC)
@@ -69,15 +137,26 @@ func StartRPCServer(wg *sync.WaitGroup, stop signalCh) {
 		log.Fatal().Err(err).Msg("Failed to register NetworkRPC service")
 	}
 
+	err = rpc.Register(new(DaemonRPC))
+	if err != nil {
+		log.Fatal().Err(err).Msg("Failed to register DaemonRPC service")
+	}
+
 	// Register a HTTP handler
 	rpc.HandleHTTP()
 
-	listener, err := net.Listen("tcp", fmt.Sprintf(":%d", RPCPort))
+	// RPC is unauthenticated, only local users may reach it
+	addr := config.GetString("RPCAddress")
+	if host, _, err := net.SplitHostPort(addr); err != nil || !isLoopback(host) {
+		log.Warn().Str("addr", addr).Msg("RPC server is not bound to a loopback address, anyone reaching it controls the node")
+	}
+
+	listener, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Fatal().Err(err).Msg("RPC Listen error")
 	}
 
-	log.Info().Int("port", RPCPort).Msg("Serving RPC server on port")
+	log.Info().Str("addr", addr).Msg("Serving RPC server")
 
 	go func() {
 		<-stop
@@ -95,3 +174,13 @@ func StartRPCServer(wg *sync.WaitGroup, stop signalCh) {
 		}
 	}()
 }
+
+// isLoopback : whether host names or is a loopback address
+func isLoopback(host string) bool {
+	if host == "localhost" {
+		return true
+	}
+
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
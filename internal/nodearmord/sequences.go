@@ -0,0 +1,80 @@
+package nodearmord
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/rs/zerolog/log"
+)
+
+const sequencesFileName = "sequences.json"
+
+// fileReplayStore : last accepted controller sequence numbers, persisted so replayed messages
+// are rejected across restarts
+type fileReplayStore struct {
+	sync.Mutex
+	sequences map[string]uint64
+}
+
+func sequencesFile() string {
+	return filepath.Join(configDir, sequencesFileName)
+}
+
+// loadReplayStore : reads persisted sequence numbers, missing file means no message accepted yet
+func loadReplayStore() *fileReplayStore {
+	store := &fileReplayStore{
+		sequences: make(map[string]uint64),
+	}
+
+	buf, err := ioutil.ReadFile(sequencesFile())
+	if os.IsNotExist(err) {
+		return store
+	}
+	if err != nil {
+		log.Error().Err(err).Msg("Error reading controller sequence numbers")
+		return store
+	}
+
+	err = json.Unmarshal(buf, &store.sequences)
+	if err != nil {
+		log.Error().Err(err).Msg("Error parsing controller sequence numbers")
+	}
+	if store.sequences == nil {
+		store.sequences = make(map[string]uint64)
+	}
+
+	return store
+}
+
+// LastSequence : returns last sequence number accepted from controller
+func (s *fileReplayStore) LastSequence(controller string) uint64 {
+	s.Lock()
+	defer s.Unlock()
+
+	return s.sequences[controller]
+}
+
+// SetLastSequence : records and persists sequence number accepted from controller
+func (s *fileReplayStore) SetLastSequence(controller string, seq uint64) error {
+	s.Lock()
+	defer s.Unlock()
+
+	s.sequences[controller] = seq
+
+	buf, err := json.MarshalIndent(s.sequences, "", "  ")
+	if err != nil {
+		return fmt.Errorf("error encoding sequence numbers: %s", err)
+	}
+
+	// A torn write would reset every sequence
+	err = writeFileAtomic(sequencesFile(), buf)
+	if err != nil {
+		return fmt.Errorf("error writing sequence numbers: %s", err)
+	}
+
+	return nil
+}
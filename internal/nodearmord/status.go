@@ -0,0 +1,182 @@
+package nodearmord
+
+import (
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/nodearmor/daemon/internal/controller"
+	"github.com/nodearmor/daemon/pkg/vpn"
+	"github.com/rs/zerolog/log"
+)
+
+// startTime : daemon start, base for reported uptime
+var startTime = time.Now()
+
+// statusChanged : wakes status reporter to send a report immediately
+var statusChanged = make(chan struct{}, 1)
+
+// ctrlAuthenticated : whether current controller connection accepts status reports
+var ctrlAuthenticated = struct {
+	sync.Mutex
+	value bool
+}{}
+
+func setAuthenticated(value bool) {
+	ctrlAuthenticated.Lock()
+	ctrlAuthenticated.value = value
+	ctrlAuthenticated.Unlock()
+}
+
+func isAuthenticated() bool {
+	ctrlAuthenticated.Lock()
+	defer ctrlAuthenticated.Unlock()
+
+	return ctrlAuthenticated.value
+}
+
+// notifyStatusChanged : requests an immediate status report, coalescing pending requests
+func notifyStatusChanged() {
+	select {
+	case statusChanged <- struct{}{}:
+	default:
+	}
+}
+
+// StartStatusReporter : sends status reports periodically and whenever network state changes
+func StartStatusReporter(wg *sync.WaitGroup, stop signalCh) {
+	interval := config.GetDuration("StatusInterval")
+	checkInterval := config.GetDuration("StatusCheckInterval")
+
+	wg.Add(1)
+
+	go func() {
+		defer wg.Done()
+
+		// Zero interval disables the corresponding ticker
+		var report, check <-chan time.Time
+		if interval > 0 {
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			report = ticker.C
+		}
+		if checkInterval > 0 {
+			ticker := time.NewTicker(checkInterval)
+			defer ticker.Stop()
+			check = ticker.C
+		}
+
+		var last controller.StatusReport
+		for {
+			select {
+			case <-report:
+			case <-statusChanged:
+			case <-check:
+				// Only state changes warrant a report between intervals
+				if !statusDiffers(last, collectStatus()) {
+					continue
+				}
+			case <-stop:
+				return
+			}
+
+			if !isAuthenticated() {
+				continue
+			}
+
+			status := collectStatus()
+			err := ctrl.SendMessage("status", status)
+			if err != nil {
+				log.Error().Err(err).Msg("Error sending status report")
+				continue
+			}
+			last = status
+		}
+	}()
+}
+
+// collectStatus : builds status report from every network with a configuration
+func collectStatus() controller.StatusReport {
+	networkConfigs.Lock()
+	configs := make([]controller.NetworkConfig, 0, len(networkConfigs.configs))
+	for _, msg := range networkConfigs.configs {
+		configs = append(configs, msg)
+	}
+	networkConfigs.Unlock()
+
+	sort.Slice(configs, func(i, j int) bool {
+		return configs[i].NetworkID < configs[j].NetworkID
+	})
+
+	quarantined, quarantineState := quarantineStatus()
+
+	report := controller.StatusReport{
+		DaemonVersion:      Version,
+		UptimeSeconds:      int64(time.Since(startTime).Seconds()),
+		ControllerEndpoint: ctrlEndpoint(),
+		ControllerRTTMs:    ctrl.LastRTT().Milliseconds(),
+		Quarantined:        quarantined,
+		QuarantineReason:   quarantineState.Reason,
+		Networks:           make([]controller.NetworkStatus, 0, len(configs)),
+	}
+
+	for _, msg := range configs {
+		report.Networks = append(report.Networks, networkStatus(msg))
+	}
+
+	return report
+}
+
+// networkStatus : queries VPN backend for state of network
+func networkStatus(msg controller.NetworkConfig) controller.NetworkStatus {
+	status := controller.NetworkStatus{
+		NetworkID: msg.NetworkID,
+		Kind:      msg.Kind,
+		Version:   msg.Version,
+	}
+
+	manager, err := vpn.GetVPNManager(msg.Kind)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	network, err := manager.GetNetwork(msg.NetworkID)
+	if err != nil {
+		status.Error = err.Error()
+		return status
+	}
+
+	vpnStatus, err := network.Status()
+	if err != nil {
+		status.Error = err.Error()
+	}
+
+	status.State = vpnStatus.State
+	status.Interface = vpnStatus.Interface
+	status.ReachablePeers = vpnStatus.ReachablePeers
+	status.RxBytes = vpnStatus.RxBytes
+	status.TxBytes = vpnStatus.TxBytes
+	for _, addr := range vpnStatus.Addresses {
+		status.Addresses = append(status.Addresses, addr.String())
+	}
+
+	return status
+}
+
+// statusDiffers : compares network state of two reports, ignoring uptime and traffic counters
+func statusDiffers(a controller.StatusReport, b controller.StatusReport) bool {
+	return !reflect.DeepEqual(stateOf(a), stateOf(b))
+}
+
+func stateOf(report controller.StatusReport) []controller.NetworkStatus {
+	networks := make([]controller.NetworkStatus, 0, len(report.Networks))
+	for _, n := range report.Networks {
+		n.RxBytes = 0
+		n.TxBytes = 0
+		networks = append(networks, n)
+	}
+
+	return networks
+}
@@ -0,0 +1,4 @@
+package nodearmord
+
+// Version : daemon version, set at build time with -ldflags "-X github.com/nodearmor/daemon/internal/nodearmord.Version=..."
+var Version = "dev"
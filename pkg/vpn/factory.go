@@ -4,6 +4,11 @@ import (
 	"fmt"
 )
 
+// Kinds : VPN kinds known to GetVPNManager
+var Kinds = []string{
+	"tinc",
+}
+
 // GetVPNManager : returns VPNManager based on string kind
 func GetVPNManager(kind string) (VPNManager, error) {
 	switch kind {
@@ -13,3 +18,15 @@ func GetVPNManager(kind string) (VPNManager, error) {
 		return nil, fmt.Errorf("Invalid VPN kind: %s", kind)
 	}
 }
+
+// SupportedKinds : returns VPN kinds GetVPNManager can create managers for
+func SupportedKinds() []string {
+	var kinds []string
+	for _, kind := range Kinds {
+		if _, err := GetVPNManager(kind); err == nil {
+			kinds = append(kinds, kind)
+		}
+	}
+
+	return kinds
+}
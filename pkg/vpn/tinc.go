@@ -4,8 +4,10 @@ import (
 	"bufio"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/sha256"
 	"crypto/x509"
 	"encoding/asn1"
+	"encoding/hex"
 	"encoding/pem"
 	"fmt"
 	"io/ioutil"
@@ -13,6 +15,8 @@ import (
 	"os"
 	"os/exec"
 	"path"
+	"strconv"
+	"strings"
 )
 
 const (
@@ -25,8 +29,43 @@ const (
 	keySize               = 2048 // tinc RSA key size
 	privKeyFile           = "rsa_key.priv"
 	pubKeyFile            = "rsa_key.pub"
+	pidFile               = "tinc.pid"
+	maxInterfaceName      = 15 // Linux interface name limit without terminating zero
 )
 
+// tincInstance : where TINC networks of this daemon live, system wide unless SetTincInstance separated them
+var tincInstance = struct {
+	// name : instance name, empty for the system wide instance
+	name string
+	// configRoot : directory holding one configuration directory per network
+	configRoot string
+	// servicePrefix : systemd service name prefix, followed by network id
+	servicePrefix string
+}{
+	configRoot:    configPath,
+	servicePrefix: servicePrefix,
+}
+
+// SetTincInstance : keeps TINC networks in configRoot with services, interfaces and pid files named after
+// instance name, so several daemons on one host can join the same network. Call before any network is used
+func SetTincInstance(name string, configRoot string) error {
+	err := CheckNetworkID(name)
+	if err != nil {
+		return fmt.Errorf("Invalid TINC instance name %q", name)
+	}
+
+	err = os.MkdirAll(configRoot, 0700)
+	if err != nil {
+		return fmt.Errorf("Error creating TINC configuration root %s: %s", configRoot, err)
+	}
+
+	tincInstance.name = name
+	tincInstance.configRoot = configRoot
+	tincInstance.servicePrefix = fmt.Sprintf("%s%s_", servicePrefix, name)
+
+	return nil
+}
+
 // TincVPN : TINC network object that controlls the tinc daemon
 type TincVPN struct {
 	id string
@@ -104,18 +143,196 @@ func (n *TincVPN) SetConfig(config NetworkConfig) error {
 				}
 			}
 
-			n.writeNetworkConfg(node.ID, connectIds)
-			n.writeNetworkUpScript(node.PrivateIPs, config.Routes)
-			n.writeNetworkUpScript(node.PrivateIPs, config.Routes)
+			err = n.writeNetworkConfg(node.ID, connectIds)
+			if err != nil {
+				return err
+			}
+
+			err = n.writeNetworkUpScript(node.PrivateIPs, config.Routes)
+			if err != nil {
+				return err
+			}
+
+			err = n.writeNetworkDownScript(node.PrivateIPs, config.Routes)
+			if err != nil {
+				return err
+			}
 		}
 
 		// Write general host config
-		n.writeHostConfig(node.ID, node.PrivateIPs, node.PublicIPs, node.PubKey)
+		err = n.writeHostConfig(node.ID, node.PrivateIPs, node.PublicIPs, node.PubKey)
+		if err != nil {
+			return err
+		}
 	}
 
 	return nil
 }
 
+// renderedFiles : returns paths of the files rendered by SetConfig, relative to the network directory
+func (n *TincVPN) renderedFiles() ([]string, error) {
+	files := []string{
+		networkConfigFile,
+		networkUpScriptFile,
+		networkDownScriptFile,
+	}
+
+	hosts, err := ioutil.ReadDir(n.hostConfigPath())
+	if err != nil {
+		return nil, fmt.Errorf("error listing hosts: %s", err)
+	}
+	for _, host := range hosts {
+		files = append(files, path.Join("hosts", host.Name()))
+	}
+
+	return files, nil
+}
+
+// ConfigHash : returns hex SHA-256 over the files rendered by SetConfig
+func (n *TincVPN) ConfigHash() (string, error) {
+	files, err := n.renderedFiles()
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.New()
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(path.Join(n.networkConfigPath(), file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %s", file, err)
+		}
+
+		// Name and length delimit files so moved content changes the hash
+		fmt.Fprintf(hash, "%s\x00%d\x00", file, len(buf))
+		hash.Write(buf)
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// DumpConfig : returns the files rendered by SetConfig one after another, private key is never included
+func (n *TincVPN) DumpConfig() (string, error) {
+	files, err := n.renderedFiles()
+	if err != nil {
+		return "", err
+	}
+
+	var dump strings.Builder
+	for _, file := range files {
+		buf, err := ioutil.ReadFile(path.Join(n.networkConfigPath(), file))
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return "", fmt.Errorf("error reading %s: %s", file, err)
+		}
+
+		fmt.Fprintf(&dump, "# %s\n", file)
+		dump.Write(buf)
+		if len(buf) > 0 && buf[len(buf)-1] != '\n' {
+			dump.WriteByte('\n')
+		}
+	}
+
+	return dump.String(), nil
+}
+
+// Status : returns service state, interface addresses, reachable peers and traffic counters
+func (n *TincVPN) Status() (NetworkStatus, error) {
+	status := NetworkStatus{
+		Interface: n.interfaceName(),
+	}
+
+	// is-active exits non-zero for inactive services but still prints the state
+	out, err := exec.Command("systemctl", "is-active", n.serviceName()).Output()
+	status.State = strings.TrimSpace(string(out))
+	if status.State == "" {
+		return status, fmt.Errorf("error querying service state: %s", err)
+	}
+
+	iface, err := net.InterfaceByName(status.Interface)
+	if err != nil {
+		// Interface only exists while daemon runs
+		return status, nil
+	}
+
+	addrs, err := iface.Addrs()
+	if err == nil {
+		for _, addr := range addrs {
+			if ipNet, ok := addr.(*net.IPNet); ok {
+				status.Addresses = append(status.Addresses, *ipNet)
+			}
+		}
+	}
+
+	status.RxBytes = readCounter(status.Interface, "rx_bytes")
+	status.TxBytes = readCounter(status.Interface, "tx_bytes")
+
+	status.ReachablePeers, err = n.reachablePeers()
+	if err != nil {
+		return status, err
+	}
+
+	return status, nil
+}
+
+// reachablePeers : returns names of nodes tinc currently reaches, excluding self
+func (n *TincVPN) reachablePeers() ([]string, error) {
+	args := append(n.instanceArgs(), "dump", "reachable", "nodes")
+	out, err := exec.Command("tinc", args...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("error listing reachable nodes: %s", err)
+	}
+
+	self := n.selfName()
+
+	var peers []string
+	for _, line := range strings.Split(string(out), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 0 || fields[0] == self {
+			continue
+		}
+		peers = append(peers, fields[0])
+	}
+
+	return peers, nil
+}
+
+// selfName : returns node name written to tinc.conf, empty if not configured
+func (n *TincVPN) selfName() string {
+	buf, err := ioutil.ReadFile(path.Join(n.networkConfigPath(), networkConfigFile))
+	if err != nil {
+		return ""
+	}
+
+	for _, line := range strings.Split(string(buf), "\n") {
+		fields := strings.SplitN(line, "=", 2)
+		if len(fields) == 2 && strings.TrimSpace(fields[0]) == "Name" {
+			return strings.TrimSpace(fields[1])
+		}
+	}
+
+	return ""
+}
+
+// readCounter : returns interface statistics counter, 0 if unavailable
+func readCounter(iface string, counter string) uint64 {
+	buf, err := ioutil.ReadFile(path.Join("/sys/class/net", iface, "statistics", counter))
+	if err != nil {
+		return 0
+	}
+
+	value, err := strconv.ParseUint(strings.TrimSpace(string(buf)), 10, 64)
+	if err != nil {
+		return 0
+	}
+
+	return value
+}
+
 func (n *TincVPN) writeNetworkConfg(selfID string, connectIds []string) error {
 	filePath := path.Join(n.networkConfigPath(), networkConfigFile)
 
@@ -133,6 +350,11 @@ func (n *TincVPN) writeNetworkConfg(selfID string, connectIds []string) error {
 
 	fmt.Fprintf(w, "Name = %s\n", selfID)
 
+	// Interface named after the network alone would clash with other instances
+	if tincInstance.name != "" {
+		fmt.Fprintf(w, "Interface = %s\n", n.interfaceName())
+	}
+
 	// Write nodes to connect to
 	for _, ip := range connectIds {
 		fmt.Fprintf(w, "ConnectTo = %s\n", ip)
@@ -282,11 +504,11 @@ func (n *TincVPN) generateKeys() error {
 
 	// Remove old keys if present
 	err := os.Remove(privKeyPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("Error removing old private key file: %s", err)
 	}
 	err = os.Remove(pubKeyPath)
-	if err != nil {
+	if err != nil && !os.IsNotExist(err) {
 		return fmt.Errorf("Error removing old public key file: %s", err)
 	}
 
@@ -345,7 +567,36 @@ func (n *TincVPN) generateKeys() error {
 }
 
 func (n *TincVPN) serviceName() string {
-	return fmt.Sprintf("%s%s", servicePrefix, n.id)
+	return fmt.Sprintf("%s%s", tincInstance.servicePrefix, n.id)
+}
+
+// interfaceName : returns network interface name. Tinc names it after the network, separated instances
+// prefix it with their name, cut to the length Linux allows
+func (n *TincVPN) interfaceName() string {
+	if tincInstance.name == "" {
+		return n.id
+	}
+
+	name := fmt.Sprintf("%.4s%s", tincInstance.name, n.id)
+	if len(name) > maxInterfaceName {
+		name = name[:maxInterfaceName]
+	}
+
+	return name
+}
+
+// instanceArgs : returns tinc and tincd arguments selecting the network, including its configuration
+// directory and pid file when the instance is separated
+func (n *TincVPN) instanceArgs() []string {
+	args := []string{"-n", n.id}
+	if tincInstance.name != "" {
+		args = append(args,
+			"-c", n.networkConfigPath(),
+			fmt.Sprintf("--pidfile=%s", path.Join(n.networkConfigPath(), pidFile)),
+		)
+	}
+
+	return args
 }
 
 func (n *TincVPN) serviceFile() string {
@@ -353,7 +604,7 @@ func (n *TincVPN) serviceFile() string {
 }
 
 func (n *TincVPN) networkConfigPath() string {
-	return path.Join(configPath, n.id)
+	return path.Join(tincInstance.configRoot, n.id)
 }
 
 func (n *TincVPN) hostConfigPath() string {
@@ -381,7 +632,7 @@ func (n *TincVPN) serviceCreate() error {
 	fmt.Fprintf(w, "\n")
 	fmt.Fprintf(w, "[Service]\n")
 	fmt.Fprintf(w, "Type=simple\n")
-	fmt.Fprintf(w, "ExecStart=/usr/sbin/tincd -D -n %s -L -R\n", n.id)
+	fmt.Fprintf(w, "ExecStart=/usr/sbin/tincd -D %s -L -R\n", strings.Join(n.instanceArgs(), " "))
 	fmt.Fprintf(w, "Restart=always\n")
 	fmt.Fprintf(w, "\n")
 	fmt.Fprintf(w, "[Install]\n")
@@ -461,7 +712,12 @@ func (d *TincVPNManager) Type() string {
 
 // CreateNetwork : creates configuration folder for TINC network and returns network pointer
 func (d *TincVPNManager) CreateNetwork(id string) (VPN, error) {
-	networkConfigPath := path.Join(configPath, id)
+	err := CheckNetworkID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	networkConfigPath := path.Join(tincInstance.configRoot, id)
 
 	if _, err := os.Stat(networkConfigPath); !os.IsNotExist(err) {
 		return nil, fmt.Errorf("Network %s already exists", id)
@@ -477,7 +733,12 @@ func (d *TincVPNManager) CreateNetwork(id string) (VPN, error) {
 
 // GetNetwork : finds TINC network pointer based on network id
 func (d *TincVPNManager) GetNetwork(id string) (VPN, error) {
-	networkConfigPath := path.Join(configPath, id)
+	err := CheckNetworkID(id)
+	if err != nil {
+		return nil, err
+	}
+
+	networkConfigPath := path.Join(tincInstance.configRoot, id)
 
 	if _, err := os.Stat(networkConfigPath); os.IsNotExist(err) {
 		return nil, fmt.Errorf("Network %s does not exist", id)
@@ -488,6 +749,34 @@ func (d *TincVPNManager) GetNetwork(id string) (VPN, error) {
 	}, nil
 }
 
+// ListNetworks : returns ids of TINC networks that have a service created by this manager, whether
+// running or not
+func (d *TincVPNManager) ListNetworks() ([]string, error) {
+	files, err := ioutil.ReadDir(serviceFilePath)
+	if err != nil {
+		return nil, fmt.Errorf("Error listing services: %s", err)
+	}
+
+	var ids []string
+	for _, file := range files {
+		name := file.Name()
+		if !strings.HasPrefix(name, tincInstance.servicePrefix) || !strings.HasSuffix(name, ".service") {
+			continue
+		}
+
+		id := strings.TrimSuffix(strings.TrimPrefix(name, tincInstance.servicePrefix), ".service")
+		if CheckNetworkID(id) != nil {
+			continue
+		}
+		if _, err := os.Stat(path.Join(tincInstance.configRoot, id)); err != nil {
+			continue
+		}
+		ids = append(ids, id)
+	}
+
+	return ids, nil
+}
+
 // DeleteNetwork : stops and removes TINC network
 func (d *TincVPNManager) DeleteNetwork(id string) error {
 	network, err := d.GetNetwork(id)
@@ -495,14 +784,16 @@ func (d *TincVPNManager) DeleteNetwork(id string) error {
 		return fmt.Errorf("Error deleting network %s: %s", id, err)
 	}
 
-	// Stop network
-	err = network.Stop()
-	if err != nil {
-		return fmt.Errorf("Error stopping network %s: %s", id, err)
+	// Stop network, unless it was only created to join and never started
+	if _, err := os.Stat((&TincVPN{id: id}).serviceFile()); err == nil {
+		err = network.Stop()
+		if err != nil {
+			return fmt.Errorf("Error stopping network %s: %s", id, err)
+		}
 	}
 
 	// Remove files
-	networkConfigPath := path.Join(configPath, id)
+	networkConfigPath := path.Join(tincInstance.configRoot, id)
 	err = os.RemoveAll(networkConfigPath)
 	if err != nil {
 		return fmt.Errorf("Error removing network configuration %s: %s", id, err)
@@ -1,9 +1,23 @@
 package vpn
 
 import (
+	"fmt"
 	"net"
+	"regexp"
 )
 
+// networkIDPattern : network ids become file and service names, so path separators and dots are refused
+var networkIDPattern = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// CheckNetworkID : returns error if id is not a valid network id
+func CheckNetworkID(id string) error {
+	if !networkIDPattern.MatchString(id) {
+		return fmt.Errorf("Invalid network id %q", id)
+	}
+
+	return nil
+}
+
 // NodeConfig : a network node configuration
 type NodeConfig struct {
 	ID         string
@@ -26,6 +40,16 @@ type NetworkConfig struct {
 	Routes []RouteConfig
 }
 
+// NetworkStatus : runtime state of a network
+type NetworkStatus struct {
+	State          string
+	Interface      string
+	Addresses      []net.IPNet
+	ReachablePeers []string
+	RxBytes        uint64
+	TxBytes        uint64
+}
+
 // VPN : vpn abstraction layer
 type VPN interface {
 	ID() string
@@ -33,6 +57,9 @@ type VPN interface {
 	Stop() error
 	Reload() error
 	SetConfig(config NetworkConfig) error
+	ConfigHash() (string, error)
+	DumpConfig() (string, error)
+	Status() (NetworkStatus, error)
 	GetPubKey() (string, error)
 }
 
@@ -42,4 +69,5 @@ type VPNManager interface {
 	CreateNetwork(id string) (VPN, error)
 	GetNetwork(id string) (VPN, error)
 	DeleteNetwork(id string) error
+	ListNetworks() ([]string, error)
 }